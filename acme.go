@@ -0,0 +1,587 @@
+package webservice
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// ACMEChallengeHTTP01 is type of challenge answered over http on port 80
+	ACMEChallengeHTTP01 = "http-01"
+	// ACMEChallengeTLSALPN01 is type of challenge answered in tls handshake on port 443
+	ACMEChallengeTLSALPN01 = "tls-alpn-01"
+
+	acmeAccountKeyFile = "acme_account.key"
+	acmeChallengePath  = "/.well-known/acme-challenge/"
+)
+
+// ACMESolver answers acme challenges of one type, such as dns-01 by updating dns records
+type ACMESolver interface {
+	// Type returns type of challenges solved
+	Type() string
+	// Present makes response of challenge of domain available to ca
+	Present(ctx context.Context, client *acme.Client, domain string, chal *acme.Challenge) error
+	// CleanUp removes response of challenge after authorization finishes
+	CleanUp(ctx context.Context, client *acme.Client, domain string, chal *acme.Challenge) error
+}
+
+// ACMEConfig stores config of certificates obtained from acme ca
+type ACMEConfig struct {
+	// DirectoryURL is directory of ca, Let's Encrypt is used if it is empty
+	DirectoryURL string
+	Email        string
+	// Hosts lists host names which certificates are obtained for,
+	// tls clients asking for other names get static certificates of Config if there are any
+	Hosts []string
+	// CacheDir stores account key and certificates
+	CacheDir string
+	// RenewBefore renews certificates expiring in it, RenewCheckInterval is interval of checks
+	RenewBefore        time.Duration
+	RenewCheckInterval time.Duration
+	// ObtainTimeout limits obtaining one certificate
+	ObtainTimeout time.Duration
+	// Solvers are tried in order for challenges offered by ca
+	Solvers []ACMESolver
+	// HTTPChallengeAddr serves http-01 challenges if it is not empty,
+	// other requests to it are redirected to https like HTTPSRedirectAddr of Config
+	HTTPChallengeAddr string
+	// HTTPClient talks to ca, tests against a local ca may trust its root by it
+	HTTPClient *http.Client
+}
+
+// BuildACMEConfig builds a default acme config solving http-01 and tls-alpn-01 challenges
+func BuildACMEConfig(cacheDir string, hosts ...string) *ACMEConfig {
+	return &ACMEConfig{
+		DirectoryURL:       acme.LetsEncryptURL,
+		Hosts:              hosts,
+		CacheDir:           cacheDir,
+		RenewBefore:        30 * 24 * time.Hour,
+		RenewCheckInterval: 12 * time.Hour,
+		ObtainTimeout:      2 * time.Minute,
+		Solvers:            []ACMESolver{BuildHTTP01Solver(), BuildTLSALPN01Solver()},
+		HTTPChallengeAddr:  ":80",
+	}
+}
+
+// BuildHTTP01Solver builds solver of http-01 challenges, responses are served by web service
+func BuildHTTP01Solver() ACMESolver {
+	return &http01Solver{responses: make(map[string]string)}
+}
+
+// BuildTLSALPN01Solver builds solver of tls-alpn-01 challenges, certificates are served by web service
+func BuildTLSALPN01Solver() ACMESolver {
+	return &tlsALPN01Solver{certs: make(map[string]*tls.Certificate)}
+}
+
+type http01Solver struct {
+	lock      sync.RWMutex
+	responses map[string]string
+}
+
+func (s *http01Solver) Type() string {
+	return ACMEChallengeHTTP01
+}
+
+func (s *http01Solver) Present(_ context.Context, client *acme.Client, _ string, chal *acme.Challenge) error {
+	response, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.responses[client.HTTP01ChallengePath(chal.Token)] = response
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *http01Solver) CleanUp(_ context.Context, client *acme.Client, _ string, chal *acme.Challenge) error {
+	s.lock.Lock()
+	delete(s.responses, client.HTTP01ChallengePath(chal.Token))
+	s.lock.Unlock()
+	return nil
+}
+
+// serveChallenge writes response of challenge path, it returns false for other paths
+func (s *http01Solver) serveChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		return false
+	}
+	s.lock.RLock()
+	response, ok := s.responses[r.URL.Path]
+	s.lock.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+	return true
+}
+
+type tlsALPN01Solver struct {
+	lock  sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+func (s *tlsALPN01Solver) Type() string {
+	return ACMEChallengeTLSALPN01
+}
+
+func (s *tlsALPN01Solver) Present(_ context.Context, client *acme.Client, domain string, chal *acme.Challenge) error {
+	cert, err := client.TLSALPN01ChallengeCert(chal.Token, domain)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.certs[domain] = &cert
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *tlsALPN01Solver) CleanUp(_ context.Context, _ *acme.Client, domain string, _ *acme.Challenge) error {
+	s.lock.Lock()
+	delete(s.certs, domain)
+	s.lock.Unlock()
+	return nil
+}
+
+// challengeCertificate returns certificate of challenge of server name, nil if there is none
+func (s *tlsALPN01Solver) challengeCertificate(name string) *tls.Certificate {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.certs[name]
+}
+
+// acmeManager obtains certificates of allowed hosts on demand, caches them on disk
+// and renews them before expiry
+type acmeManager struct {
+	ACMEConfig
+	hosts  map[string]bool
+	client *acme.Client
+	logger Logger
+	stop   chan struct{}
+
+	lock       sync.Mutex
+	registered bool
+	certs      map[string]*tls.Certificate
+	obtaining  map[string]*acmeObtain
+}
+
+// acmeObtain lets concurrent handshakes of a host wait for one order
+type acmeObtain struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+func buildACMEManager(conf *ACMEConfig, log Logger) (*acmeManager, error) {
+	m := &acmeManager{
+		ACMEConfig: *conf,
+		hosts:      make(map[string]bool, len(conf.Hosts)),
+		logger:     log,
+		stop:       make(chan struct{}),
+		certs:      make(map[string]*tls.Certificate),
+		obtaining:  make(map[string]*acmeObtain),
+	}
+	for _, host := range conf.Hosts {
+		m.hosts[normalizeHost(host)] = true
+	}
+	if len(m.hosts) == 0 || strings.TrimSpace(m.CacheDir) == "" {
+		return nil, ErrorInvalidArgument
+	}
+	if len(m.Solvers) == 0 {
+		m.Solvers = []ACMESolver{BuildHTTP01Solver(), BuildTLSALPN01Solver()}
+	}
+	if m.RenewBefore <= 0 {
+		m.RenewBefore = 30 * 24 * time.Hour
+	}
+	if m.RenewCheckInterval <= 0 {
+		m.RenewCheckInterval = 12 * time.Hour
+	}
+	if m.ObtainTimeout <= 0 {
+		m.ObtainTimeout = 2 * time.Minute
+	}
+
+	if err := os.MkdirAll(m.CacheDir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := m.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	m.client = &acme.Client{
+		Key:          key,
+		DirectoryURL: m.DirectoryURL,
+		HTTPClient:   m.HTTPClient,
+		UserAgent:    "webservice",
+	}
+	return m, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// accountKey loads account key from cache, a new key is generated and cached if there is none
+func (m *acmeManager) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(m.CacheDir, acmeAccountKeyFile)
+	if data, err := ioutil.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid acme account key %v", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// allowed checks whether certificate of name is obtained from ca
+func (m *acmeManager) allowed(name string) bool {
+	return m.hosts[normalizeHost(name)]
+}
+
+// solvesTLSALPN checks whether tls-alpn-01 challenges are answered in handshakes
+func (m *acmeManager) solvesTLSALPN() bool {
+	for _, s := range m.Solvers {
+		if _, ok := s.(*tlsALPN01Solver); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getCertificate returns challenge certificate or certificate of allowed host,
+// handled is false if neither is asked for
+func (m *acmeManager) getCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, handled bool, err error) {
+	name := normalizeHost(hello.ServerName)
+	for _, proto := range hello.SupportedProtos {
+		if proto != acme.ALPNProto {
+			continue
+		}
+		for _, s := range m.Solvers {
+			if alpn, ok := s.(*tlsALPN01Solver); ok {
+				if cert := alpn.challengeCertificate(name); cert != nil {
+					return cert, true, nil
+				}
+			}
+		}
+		return nil, true, fmt.Errorf("no acme challenge certificate of %v", name)
+	}
+
+	if !m.allowed(name) {
+		return nil, false, nil
+	}
+	cert, err = m.certificate(name)
+	return cert, true, err
+}
+
+// certificate returns certificate of host from memory, cache or ca in order
+func (m *acmeManager) certificate(name string) (*tls.Certificate, error) {
+	m.lock.Lock()
+	cert := m.certs[name]
+	m.lock.Unlock()
+	if cert != nil {
+		return cert, nil
+	}
+
+	if cert, err := m.loadCache(name); err == nil && time.Now().Before(cert.Leaf.NotAfter) {
+		m.lock.Lock()
+		m.certs[name] = cert
+		m.lock.Unlock()
+		return cert, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		m.logger.Warn("load cached certificate of", name, "failed with", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.ObtainTimeout)
+	defer cancel()
+	return m.obtain(ctx, name)
+}
+
+// obtain orders certificate of host, concurrent calls of a host share one order
+func (m *acmeManager) obtain(ctx context.Context, name string) (*tls.Certificate, error) {
+	m.lock.Lock()
+	if o, ok := m.obtaining[name]; ok {
+		m.lock.Unlock()
+		select {
+		case <-o.done:
+			return o.cert, o.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	o := &acmeObtain{done: make(chan struct{})}
+	m.obtaining[name] = o
+	m.lock.Unlock()
+
+	o.cert, o.err = m.order(ctx, name)
+	if o.err != nil {
+		m.logger.Error("obtain certificate of", name, "failed with", o.err)
+	} else {
+		m.logger.Trace("obtained certificate of", name, "expiring at", o.cert.Leaf.NotAfter)
+		if err := m.saveCache(name, o.cert); err != nil {
+			m.logger.Warn("cache certificate of", name, "failed with", err)
+		}
+	}
+
+	m.lock.Lock()
+	if o.err == nil {
+		m.certs[name] = o.cert
+	}
+	delete(m.obtaining, name)
+	m.lock.Unlock()
+	close(o.done)
+	return o.cert, o.err
+}
+
+// register registers account key with ca once
+func (m *acmeManager) register(ctx context.Context) error {
+	m.lock.Lock()
+	registered := m.registered
+	m.lock.Unlock()
+	if registered {
+		return nil
+	}
+
+	account := &acme.Account{}
+	if m.Email != "" {
+		account.Contact = []string{"mailto:" + m.Email}
+	}
+	if _, err := m.client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return err
+	}
+	m.lock.Lock()
+	m.registered = true
+	m.lock.Unlock()
+	return nil
+}
+
+// order runs an acme order of host and returns issued certificate
+func (m *acmeManager) order(ctx context.Context, name string) (*tls.Certificate, error) {
+	if err := m.register(ctx); err != nil {
+		return nil, err
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(name))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range order.AuthzURLs {
+		if err := m.authorize(ctx, u, name); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = m.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	return parseCertificateChain(name, der, key)
+}
+
+// authorize answers a challenge of authorization by the first solver supporting it
+func (m *acmeManager) authorize(ctx context.Context, url, name string) error {
+	z, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if z.Status == acme.StatusValid {
+		return nil
+	}
+
+	var solver ACMESolver
+	var chal *acme.Challenge
+	for _, s := range m.Solvers {
+		for _, c := range z.Challenges {
+			if c.Type == s.Type() {
+				solver, chal = s, c
+				break
+			}
+		}
+		if solver != nil {
+			break
+		}
+	}
+	if solver == nil {
+		return fmt.Errorf("no solver of challenges offered for %v", name)
+	}
+
+	if err := solver.Present(ctx, m.client, name, chal); err != nil {
+		return err
+	}
+	defer func() {
+		if err := solver.CleanUp(ctx, m.client, name, chal); err != nil {
+			m.logger.Warn("clean up", chal.Type, "challenge of", name, "failed with", err)
+		}
+	}()
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, z.URI)
+	return err
+}
+
+// parseCertificateChain builds tls certificate of der chain and checks it is valid for name
+func parseCertificateChain(name string, der [][]byte, key crypto.Signer) (*tls.Certificate, error) {
+	if len(der) == 0 {
+		return nil, ErrorNotFound
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := leaf.VerifyHostname(name); err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func (m *acmeManager) cachePath(name string) string {
+	return filepath.Join(m.CacheDir, name+".pem")
+}
+
+// saveCache writes key and chain of certificate into cache file of host
+func (m *acmeManager) saveCache(name string, cert *tls.Certificate) error {
+	key, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return ErrorInvalidArgument
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, c := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+
+	// file is replaced by rename so that readers never see partial data
+	tmp := m.cachePath(name) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.cachePath(name))
+}
+
+// loadCache reads certificate of host from cache file
+func (m *acmeManager) loadCache(name string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(m.cachePath(name))
+	if err != nil {
+		return nil, err
+	}
+	var key crypto.Signer
+	var der [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, err
+			}
+		case "CERTIFICATE":
+			der = append(der, block.Bytes)
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("no private key in %v", m.cachePath(name))
+	}
+	return parseCertificateChain(name, der, key)
+}
+
+// expiring checks whether certificate should be renewed
+func (m *acmeManager) expiring(cert *tls.Certificate) bool {
+	return time.Now().Add(m.RenewBefore).After(cert.Leaf.NotAfter)
+}
+
+// renew renews loaded certificates which are expiring, current certificates are served meanwhile
+func (m *acmeManager) renew() {
+	m.lock.Lock()
+	var names []string
+	for name, cert := range m.certs {
+		if m.expiring(cert) {
+			names = append(names, name)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, name := range names {
+		m.logger.Trace("renew certificate of", name)
+		ctx, cancel := context.WithTimeout(context.Background(), m.ObtainTimeout)
+		m.obtain(ctx, name)
+		cancel()
+	}
+}
+
+// start checks certificates for renewal periodically until close
+func (m *acmeManager) start() {
+	go func() {
+		ticker := time.NewTicker(m.RenewCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.renew()
+			}
+		}
+	}()
+}
+
+func (m *acmeManager) close() {
+	close(m.stop)
+}
+
+// httpHandler answers http-01 challenges and passes other requests to next
+func (m *acmeManager) httpHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, s := range m.Solvers {
+			if h, ok := s.(*http01Solver); ok && h.serveChallenge(w, r) {
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
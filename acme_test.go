@@ -0,0 +1,156 @@
+package webservice
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+func buildTestACMEManager(t *testing.T, dir string, hosts ...string) *acmeManager {
+	conf := BuildACMEConfig(dir, hosts...)
+	conf.RenewBefore = 2 * time.Hour
+	m, err := buildACMEManager(conf, &logger{level: logLevelError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestACMESolvers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := buildTestACMEManager(t, dir, "a.example.com")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{Key: key}
+	chal := &acme.Challenge{Token: "token"}
+	ctx := context.Background()
+
+	handler := m.httpHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	http01, alpn := m.Solvers[0], m.Solvers[1]
+	if err := http01.Present(ctx, client, "a.example.com", chal); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := client.HTTP01ChallengeResponse(chal.Token)
+	if code, body := get(client.HTTP01ChallengePath(chal.Token)); code != http.StatusOK || body != expected {
+		t.Fatal("unexpected challenge response", code, body)
+	}
+	if code, _ := get("/index.html"); code != http.StatusTeapot {
+		t.Fatal("request is not passed to next handler, got", code)
+	}
+	http01.CleanUp(ctx, client, "a.example.com", chal)
+	if code, _ := get(client.HTTP01ChallengePath(chal.Token)); code != http.StatusNotFound {
+		t.Fatal("cleaned challenge is still served, got", code)
+	}
+
+	hello := &tls.ClientHelloInfo{ServerName: "a.example.com", SupportedProtos: []string{acme.ALPNProto}}
+	if _, handled, err := m.getCertificate(hello); !handled || err == nil {
+		t.Fatal("unexpected challenge certificate before presenting", handled, err)
+	}
+	if err := alpn.Present(ctx, client, "a.example.com", chal); err != nil {
+		t.Fatal(err)
+	}
+	if cert, handled, err := m.getCertificate(hello); !handled || err != nil || cert == nil {
+		t.Fatal("challenge certificate is not served", handled, err)
+	}
+}
+
+func TestACMECacheAndHostPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := buildTestACMEManager(t, dir, "A.example.com.")
+	cert, key := createTestCertificate(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "a.example.com"},
+		DNSNames: []string{"a.example.com"},
+	}, nil, nil)
+	if err := m.saveCache("a.example.com", &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	// account key and certificates are reused by a new manager
+	reloaded := buildTestACMEManager(t, dir, "a.example.com")
+	if reloaded.client.Key.(*ecdsa.PrivateKey).D.Cmp(m.client.Key.(*ecdsa.PrivateKey).D) != 0 {
+		t.Fatal("account key is not reused")
+	}
+	got, handled, err := reloaded.getCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	if !handled || err != nil || got.Leaf.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Fatal("cached certificate is not served", handled, err)
+	}
+	if !reloaded.expiring(got) {
+		t.Fatal("certificate expiring within RenewBefore should be renewed")
+	}
+
+	if _, handled, _ := reloaded.getCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"}); handled {
+		t.Fatal("certificate of host out of allow list is obtained")
+	}
+	ws := buildTestService(nil)
+	ws.acme = reloaded
+	if _, err := ws.getCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"}); err != ErrorHostNotAllowed {
+		t.Fatal("expected host not allowed, got", err)
+	}
+}
+
+// TestACMEObtain obtains a certificate from a local acme ca such as pebble started with
+// PEBBLE_VA_ALWAYS_VALID=1, it runs only if ACME_TEST_DIRECTORY is set
+func TestACMEObtain(t *testing.T) {
+	directory := os.Getenv("ACME_TEST_DIRECTORY")
+	if directory == "" {
+		t.Skip("ACME_TEST_DIRECTORY is not set")
+	}
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := BuildACMEConfig(dir, "acme.example.com")
+	conf.DirectoryURL = directory
+	conf.HTTPClient = &http.Client{Transport: &http.Transport{
+		// local test ca serves its directory by an untrusted certificate
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	m, err := buildACMEManager(conf, &logger{level: logLevelError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, handled, err := m.getCertificate(&tls.ClientHelloInfo{ServerName: "acme.example.com"})
+	if !handled || err != nil {
+		t.Fatal("obtain certificate failed with", err)
+	}
+	if err := cert.Leaf.VerifyHostname("acme.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.loadCache("acme.example.com"); err != nil {
+		t.Fatal("certificate is not cached", err)
+	}
+}
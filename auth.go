@@ -1,22 +1,33 @@
 package webservice
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
 	"net/http"
-	"strings"
 )
 
-func (ws webService) checkAuth(path, remoteAddr string) *ServiceResponse {
-	parts := strings.Split(remoteAddr, ":")
-	if len(parts) != 2 {
-		return &ServiceResponse{
-			Status:  http.StatusBadRequest,
-			Message: "invalid remoteaddr",
-			Data:    map[int]int{},
+// UnixSocketClient is client ip of requests accepted by unix listeners, it can be listed in AuthMap
+const UnixSocketClient = "unix"
+
+// checkAuth checks client ip against AuthMap entries of both matched route and request path
+func (ws webService) checkAuth(route string, r *http.Request) *ServiceResponse {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); !ok {
+			return &ServiceResponse{
+				Status:  http.StatusBadRequest,
+				Message: "invalid remoteaddr",
+				Data:    map[int]int{},
+			}
 		}
+		// peers of unix sockets have no address
+		ip = UnixSocketClient
 	}
 
-	auth := ws.haveAuth(path, parts[0])
-	ws.Logger.Trace("webService", "checkAuth", path, parts[0], auth)
+	auth := ws.haveAuth(r.URL.Path, ip) && (route == "" || ws.haveAuth(route, ip))
+	ws.Logger.Trace("webService", "checkAuth", r.URL.Path, route, ip, auth)
 	if !auth {
 		return &ServiceResponse{
 			Status:  http.StatusForbidden,
@@ -28,6 +39,15 @@ func (ws webService) checkAuth(path, remoteAddr string) *ServiceResponse {
 	return nil
 }
 
+// clientIP resolves client ip of remote address in the same way as checkAuth
+func clientIP(remoteAddr string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return ip
+}
+
 func (ws webService) haveAuth(path, ip string) bool {
 	if len(ws.AuthMap) == 0 {
 		return true
@@ -40,3 +60,51 @@ func (ws webService) haveAuth(path, ip string) bool {
 
 	return true
 }
+
+// PrincipalSchemeSignature marks principal authenticated by hmac request signature
+const PrincipalSchemeSignature = "signature"
+
+// Principal stores identity of authenticated caller
+type Principal struct {
+	// ID is the identity of caller, such as signing key id
+	ID string
+	// Scheme is the way caller is authenticated
+	Scheme string
+	// Certificate is verified client certificate of PrincipalSchemeClientCertificate
+	Certificate *x509.Certificate
+}
+
+// PrincipalFromRequest returns principal authenticated by web service, nil for anonymous request
+func PrincipalFromRequest(r *http.Request) *Principal {
+	p, _ := r.Context().Value(contextKeyPrincipal).(*Principal)
+	return p
+}
+
+// withPrincipal returns shallow copy of request carrying principal
+func withPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKeyPrincipal, p))
+}
+
+// checkSignature verifies request signature if route requires it,
+// the returned request carries principal of signing key
+func (ws *webService) checkSignature(route string, r *http.Request) (*http.Request, *ServiceResponse) {
+	verifier, ok := ws.RouteSignatures[route]
+	if !ok || verifier == nil {
+		return r, nil
+	}
+
+	principal, err := verifier.Verify(r)
+	if err != nil {
+		ws.Logger.Warn("webService", "checkSignature", route, "failed with", err)
+		if errors.Is(err, ErrorBodyTooLarge) || errors.Is(err, ErrorMalformedBody) ||
+			errors.Is(err, ErrorUnsupportedEncoding) {
+			return r, BodyErrorResponse(err)
+		}
+		return r, &ServiceResponse{
+			Status:  http.StatusUnauthorized,
+			Message: err.Error(),
+			Data:    map[int]int{},
+		}
+	}
+	return withPrincipal(r, principal), nil
+}
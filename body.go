@@ -0,0 +1,301 @@
+package webservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// BodyConfig stores config of reading request body
+type BodyConfig struct {
+	// MaxSize limits bytes of body after decoding, zero means no limit
+	MaxSize int64
+	// MemoryLimit is the bytes kept in memory, the rest spills to a temporary file
+	MemoryLimit int64
+	// TempDir is the directory of temporary files, empty means os.TempDir
+	TempDir string
+	// Decompress decodes gzip encoded body
+	Decompress bool
+}
+
+// BuildBodyConfig builds a default body config
+func BuildBodyConfig() *BodyConfig {
+	return &BodyConfig{
+		MaxSize:     64 << 20,
+		MemoryLimit: 1 << 20,
+		Decompress:  true,
+	}
+}
+
+// Body stores request body which can be read more than once
+type Body struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+// Size returns bytes of body
+func (b *Body) Size() int64 {
+	return b.size
+}
+
+// Reader returns a new reader reading body from start
+func (b *Body) Reader() io.ReadSeeker {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.data)
+}
+
+// Bytes returns whole body, body spilled to disk is read back into memory
+func (b *Body) Bytes() ([]byte, error) {
+	if b.file == nil {
+		return b.data, nil
+	}
+	return ioutil.ReadAll(b.Reader())
+}
+
+// Close removes temporary file of body
+func (b *Body) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	file := b.file
+	b.file = nil
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// requestBody limits bytes read from request body,
+// it also keeps bodies buffered from it so that they can be closed after request is handled
+type requestBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	err      error
+	buffered []*Body
+}
+
+func newRequestBody(body io.ReadCloser, limit int64) *requestBody {
+	return &requestBody{ReadCloser: body, limit: limit}
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.limit <= 0 {
+		return b.ReadCloser.Read(p)
+	}
+
+	// read one more byte than remaining to find out whether body exceeds limit
+	remaining := b.limit - b.read
+	if int64(len(p)) > remaining+1 {
+		p = p[:remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > remaining {
+		n = int(remaining)
+		err = ErrorBodyTooLarge
+	}
+	b.read += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// closeBuffered removes temporary files of bodies buffered from request
+func (b *requestBody) closeBuffered() {
+	for _, body := range b.buffered {
+		body.Close()
+	}
+	b.buffered = nil
+}
+
+// replayBody reads a buffered body, it is rewound each time body is read by ReadBody
+type replayBody struct {
+	io.ReadSeeker
+	body *Body
+}
+
+func (b *replayBody) Close() error {
+	return nil
+}
+
+// rewindBody rewinds body of request buffered by ReadBody, it returns nil if body is not buffered
+func rewindBody(r *http.Request) *replayBody {
+	rb, ok := r.Body.(*replayBody)
+	if !ok {
+		return nil
+	}
+	rb.Seek(0, io.SeekStart)
+	return rb
+}
+
+// ReadBody reads body of request into a Body which can be read more than once,
+// the request body is replaced so that it can be read again by others.
+// Body is closed by web service after handler returns, callers out of web service should close it.
+func ReadBody(r *http.Request, conf *BodyConfig, logger Logger) (body *Body, err error) {
+	logger.Debug("entered...")
+	defer func() { logger.Debug("done with error", err) }()
+
+	if conf == nil {
+		conf = BuildBodyConfig()
+	}
+
+	if rb := rewindBody(r); rb != nil {
+		return rb.body, nil
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return &Body{}, nil
+	}
+	if bodyConsumedByForm(r) {
+		return nil, ErrorBodyConsumed
+	}
+
+	var src io.Reader = r.Body
+	decoded := false
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		if conf.Decompress {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				logger.Warn("gzip.NewReader failed with", err)
+				return nil, ErrorMalformedBody
+			}
+			defer zr.Close()
+			src, decoded = zr, true
+		}
+	default:
+		if conf.Decompress {
+			logger.Warn("unsupported content encoding", encoding)
+			return nil, ErrorUnsupportedEncoding
+		}
+	}
+
+	body, err = bufferBody(src, conf)
+	if err != nil {
+		if decoded && !errors.Is(err, ErrorBodyTooLarge) {
+			err = ErrorMalformedBody
+		}
+		return nil, err
+	}
+
+	if rb, ok := r.Body.(*requestBody); ok {
+		rb.buffered = append(rb.buffered, body)
+	}
+	replaceBody(r, body)
+	if decoded {
+		r.Header.Del("Content-Encoding")
+	}
+	return body, nil
+}
+
+// replaceBody replaces body of request by buffered body
+func replaceBody(r *http.Request, body *Body) {
+	r.Body = &replayBody{ReadSeeker: body.Reader(), body: body}
+	r.ContentLength = body.size
+	r.GetBody = func() (io.ReadCloser, error) {
+		return &replayBody{ReadSeeker: body.Reader(), body: body}, nil
+	}
+}
+
+// readBodyInMemory reads body of request like ReadBody, but body spilled to a temporary file
+// is read back into memory and the file is removed unless web service removes it after request
+func readBodyInMemory(r *http.Request, conf *BodyConfig, logger Logger) (*Body, error) {
+	_, managed := r.Body.(*requestBody)
+	_, buffered := r.Body.(*replayBody)
+	body, err := ReadBody(r, conf, logger)
+	if err != nil || managed || buffered || body.file == nil {
+		return body, err
+	}
+
+	data, err := body.Bytes()
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body = &Body{data: data, size: int64(len(data))}
+	replaceBody(r, body)
+	return body, nil
+}
+
+// bufferBody reads src into memory until MemoryLimit and spills the rest to a temporary file
+func bufferBody(src io.Reader, conf *BodyConfig) (*Body, error) {
+	if conf.MaxSize > 0 {
+		src = io.LimitReader(src, conf.MaxSize+1)
+	}
+
+	memoryLimit := conf.MemoryLimit
+	if memoryLimit <= 0 {
+		memoryLimit = 1 << 20
+	}
+	buf := &bytes.Buffer{}
+	n, err := io.CopyN(buf, src, memoryLimit+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n <= memoryLimit {
+		if conf.MaxSize > 0 && n > conf.MaxSize {
+			return nil, ErrorBodyTooLarge
+		}
+		return &Body{data: buf.Bytes(), size: n}, nil
+	}
+
+	file, err := ioutil.TempFile(conf.TempDir, "body-")
+	if err != nil {
+		return nil, err
+	}
+	body := &Body{file: file}
+	size, err := io.Copy(file, io.MultiReader(buf, src))
+	if err == nil && conf.MaxSize > 0 && size > conf.MaxSize {
+		err = ErrorBodyTooLarge
+	}
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	body.size = size
+	return body, nil
+}
+
+// bodyConsumedByForm checks whether request body has been read by form parsing
+func bodyConsumedByForm(r *http.Request) bool {
+	if r.MultipartForm != nil {
+		return true
+	}
+	if r.PostForm == nil {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded"
+}
+
+// BodyErrorResponse builds service response of error returned by reading request body
+func BodyErrorResponse(err error) *ServiceResponse {
+	status, message := http.StatusBadRequest, "bad request body"
+	switch {
+	case errors.Is(err, ErrorBodyTooLarge):
+		status, message = http.StatusRequestEntityTooLarge, "request body is too large"
+	case errors.Is(err, ErrorUnsupportedEncoding):
+		status, message = http.StatusUnsupportedMediaType, "unsupported content encoding"
+	case errors.Is(err, ErrorWrongMethod):
+		status, message = http.StatusMethodNotAllowed, "method not allowed"
+	case errors.Is(err, ErrorBodyConsumed):
+		status, message = http.StatusInternalServerError, "request body has been consumed"
+	}
+	return &ServiceResponse{
+		Status:     status,
+		Message:    message,
+		Data:       map[int]int{},
+		StatusCode: status,
+	}
+}
@@ -0,0 +1,140 @@
+package webservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func buildTestService(handlers map[string]RequestHandlerFunc) *webService {
+	conf := BuildConfig()
+	conf.Logger = &logger{level: logLevelError}
+	conf.Handlers = handlers
+	ws := &webService{Config: *conf, server: &http.Server{Addr: "test"}}
+	ws.initRequestLayers()
+	return ws
+}
+
+func TestReadBodyReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	payload := strings.Repeat("x", 64)
+	r := httptest.NewRequest("POST", "/data", strings.NewReader(payload))
+	conf := &BodyConfig{MaxSize: 1024, MemoryLimit: 16, TempDir: dir}
+	log := &logger{level: logLevelError}
+	body, err := ReadBody(r, conf, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("body is not spilled to disk, got %v files", len(files))
+	}
+
+	for i := 0; i < 2; i++ {
+		again, err := ReadBody(r, conf, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := again.Bytes(); string(data) != payload {
+			t.Fatalf("unexpected body %q", data)
+		}
+		if data, _ := ioutil.ReadAll(r.Body); string(data) != payload {
+			t.Fatalf("unexpected request body %q", data)
+		}
+	}
+
+	body.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("temporary file is not removed")
+	}
+}
+
+func TestGetDataBodyOutOfService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	t.Setenv("TMPDIR", dir)
+
+	// body larger than memory limit of default config is spilled while reading
+	payload := strings.Repeat("x", 2<<20)
+	r := httptest.NewRequest("POST", "/data", strings.NewReader(payload))
+	data, err := GetDataBody(r, &logger{level: logLevelError})
+	if err != nil || string(data) != payload {
+		t.Fatalf("unexpected body of %v bytes, error %v", len(data), err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("temporary file of body is left behind")
+	}
+	if again, _ := ioutil.ReadAll(r.Body); string(again) != payload {
+		t.Fatalf("body can not be read again")
+	}
+}
+
+func TestReadBodyGzip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Write([]byte("name=value"))
+	zw.Close()
+
+	r := httptest.NewRequest("POST", "/data", buf)
+	r.Header.Set("Content-Encoding", "gzip")
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	data, err := GetDataBody(r, &logger{level: logLevelError})
+	if err != nil || string(data) != "name=value" {
+		t.Fatalf("unexpected body %q with error %v", data, err)
+	}
+	if r.PostForm.Get("name") != "value" {
+		t.Fatalf("form is not parsed from decoded body, got %v", r.PostForm)
+	}
+
+	r = httptest.NewRequest("POST", "/data", strings.NewReader("plain"))
+	r.Header.Set("Content-Encoding", "gzip")
+	if _, err := ReadBody(r, nil, &logger{level: logLevelError}); err != ErrorMalformedBody {
+		t.Fatalf("expected malformed body error, got %v", err)
+	}
+}
+
+func TestDispatchBodySize(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+		if _, err := ReadBody(r, nil, &logger{level: logLevelError}); err != nil {
+			return BodyErrorResponse(err)
+		}
+		return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+	}
+	ws := buildTestService(map[string]RequestHandlerFunc{"/small": handler, "/large": handler})
+	ws.MaxBodySize = 8
+	ws.RouteMaxBodySizes = map[string]int64{"/large": 1024}
+
+	do := func(path string, body string, chunked bool) int {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.RemoteAddr = "127.0.0.1:1234"
+		if chunked {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		ws.dispatch(w, r)
+		return w.Code
+	}
+
+	if code := do("/small", "0123456789", false); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for declared length, got %v", code)
+	}
+	if code := do("/small", "0123456789", true); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for chunked body, got %v", code)
+	}
+	if code := do("/large", "0123456789", false); code != http.StatusOK {
+		t.Fatalf("expected route limit to allow body, got %v", code)
+	}
+}
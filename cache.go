@@ -0,0 +1,595 @@
+package webservice
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedResponse stores a response cached by http cache,
+// a response with Vary but without Status is a marker pointing to its variants
+type CachedResponse struct {
+	Status     int
+	Header     http.Header
+	Body       []byte
+	Vary       []string
+	StoredAt   time.Time
+	Expires    time.Time
+	StaleUntil time.Time
+	// MustRevalidate disables serving stale response
+	MustRevalidate bool
+}
+
+func (cr *CachedResponse) isVaryMarker() bool {
+	return cr.Status == 0 && len(cr.Vary) > 0
+}
+
+func (cr *CachedResponse) size() int64 {
+	size := int64(len(cr.Body))
+	for k, v := range cr.Header {
+		size += int64(len(k))
+		for _, vv := range v {
+			size += int64(len(vv))
+		}
+	}
+	return size
+}
+
+func (cr *CachedResponse) hasValidators() bool {
+	return cr.Header.Get("ETag") != "" || cr.Header.Get("Last-Modified") != ""
+}
+
+// cacheControl stores parsed Cache-Control directives
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value := d, ""
+			if i := strings.Index(d, "="); i >= 0 {
+				name, value = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheableStatus lists statuses cacheable by default
+var cacheableStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+type httpCache struct {
+	CacheConfig
+	logger Logger
+
+	revalidating     map[string]bool
+	revalidatingLock sync.Mutex
+}
+
+func buildHTTPCache(conf *CacheConfig) *httpCache {
+	if conf == nil {
+		conf = BuildCacheConfig()
+	}
+	c := &httpCache{
+		CacheConfig:  *conf,
+		logger:       ConvertLoggerMust(conf.Logger),
+		revalidating: make(map[string]bool),
+	}
+	if c.Store == nil {
+		c.Store = BuildMemoryCacheStore(c.MaxSize)
+	}
+	return c
+}
+
+// cacheKeyPrefix returns key prefix of all cached responses of host and request uri
+func cacheKeyPrefix(host, uri string) string {
+	return strings.ToLower(host) + uri + "|"
+}
+
+func varyKey(key string, vary []string, r *http.Request) string {
+	parts := make([]string, 0, len(vary)+1)
+	parts = append(parts, key)
+	for _, name := range vary {
+		parts = append(parts, http.CanonicalHeaderKey(name)+"="+strings.Join(r.Header[http.CanonicalHeaderKey(name)], ","))
+	}
+	return strings.Join(parts, "\n")
+}
+
+func (c *httpCache) Purge(host, uri string) {
+	c.Store.DeletePrefix(cacheKeyPrefix(host, uri))
+}
+
+func (c *httpCache) PurgePrefix(host, prefix string) int {
+	return c.Store.DeletePrefix(strings.ToLower(host) + prefix)
+}
+
+// lookup returns cached response of request and its key, variants are resolved by Vary marker
+func (c *httpCache) lookup(r *http.Request) (*CachedResponse, string) {
+	key := cacheKeyPrefix(r.Host, r.URL.RequestURI()) + r.Method
+	entry, ok := c.Store.Get(key)
+	if !ok {
+		return nil, key
+	}
+	if entry.isVaryMarker() {
+		key = varyKey(key, entry.Vary, r)
+		if entry, ok = c.Store.Get(key); !ok {
+			return nil, key
+		}
+	}
+	return entry, key
+}
+
+func (c *httpCache) Handler(next RequestHandlerFunc) RequestHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, ws WebService) *ServiceResponse {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			resp := next(w, r, ws)
+			// unsafe methods invalidate cached responses of the uri
+			c.Purge(r.Host, r.URL.RequestURI())
+			return resp
+		}
+
+		reqCC := parseCacheControl(r.Header)
+		if reqCC.has("no-store") || upgradeType(r.Header) != "" {
+			return next(w, r, ws)
+		}
+
+		entry, _ := c.lookup(r)
+		now := time.Now()
+		if entry != nil && !reqCC.has("no-cache") {
+			maxAge, limited := reqCC.seconds("max-age")
+			if now.Before(entry.Expires) && (!limited || now.Sub(entry.StoredAt) <= maxAge) {
+				c.serve(w, r, entry, "HIT")
+				return nil
+			}
+			if !entry.MustRevalidate && now.Before(entry.StaleUntil) && c.revalidateAsync(r, next, ws, entry) {
+				c.serve(w, r, entry, "STALE")
+				return nil
+			}
+		}
+
+		c.fetch(w, r, next, ws, entry)
+		return nil
+	}
+}
+
+// fetch calls handler, stores its cacheable response and responses client
+func (c *httpCache) fetch(w http.ResponseWriter, r *http.Request, next RequestHandlerFunc, ws WebService, entry *CachedResponse) {
+	rec := c.record(w, r, next, ws, entry)
+	if rec.passthrough {
+		return
+	}
+
+	if entry != nil && rec.status == http.StatusNotModified && !c.clientConditional(r) {
+		c.serve(w, r, c.refresh(r, entry, rec.header), "REVALIDATED")
+		return
+	}
+
+	c.store(r, rec)
+	copyHeader(w.Header(), rec.header)
+	w.Header().Set("X-Cache", "MISS")
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
+
+// record calls handler with a recorder, validators of entry are sent as conditional headers
+func (c *httpCache) record(w http.ResponseWriter, r *http.Request, next RequestHandlerFunc, ws WebService, entry *CachedResponse) *cacheRecorder {
+	if entry != nil && entry.hasValidators() && !c.clientConditional(r) {
+		r = r.Clone(r.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		if lm := entry.Header.Get("Last-Modified"); lm != "" {
+			r.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	rec := &cacheRecorder{w: w, header: http.Header{}, limit: c.MaxEntrySize}
+	resp := next(rec, r, ws)
+	state := requestStateFromRequest(r)
+	if state == nil {
+		state = requestStateOfWriter(w)
+	}
+	// response carrying nonce, csrf token or session data of request is not shared
+	rec.stateful = state != nil && state.used
+	if resp != nil {
+		if resp.StatusCode > 0 && resp.StatusCode != 200 {
+			jsonResponseWithStatus(rec, r, resp, resp.StatusCode, "http cache", c.logger)
+		} else {
+			jsonResponse(rec, r, resp, "http cache", c.logger)
+		}
+	}
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	return rec
+}
+
+func (c *httpCache) clientConditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// statelessRequest reports whether r carries no credentials or session cookie, only such requests
+// are revalidated after response since handler then runs without session, csrf or principal state
+func statelessRequest(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		return false
+	}
+	return PrincipalFromRequest(r) == nil
+}
+
+// revalidateAsync revalidates entry in background, it returns false if stale entry should not be
+// served because request is stateful or service has no free slot to revalidate it
+func (c *httpCache) revalidateAsync(r *http.Request, next RequestHandlerFunc, ws WebService, entry *CachedResponse) bool {
+	if !statelessRequest(r) {
+		return false
+	}
+	release := func() {}
+	if s, ok := ws.(*webService); ok {
+		route, _ := s.handerForPath(r.URL.Path)
+		if release = s.tryConcurrency(route); release == nil {
+			return false
+		}
+	}
+
+	key := cacheKeyPrefix(r.Host, r.URL.RequestURI()) + r.Method
+	c.revalidatingLock.Lock()
+	if c.revalidating[key] {
+		c.revalidatingLock.Unlock()
+		release()
+		return true
+	}
+	c.revalidating[key] = true
+	c.revalidatingLock.Unlock()
+
+	bg := r.Clone(context.Background())
+	bg.Header.Del("If-None-Match")
+	bg.Header.Del("If-Modified-Since")
+	go func() {
+		defer func() {
+			c.revalidatingLock.Lock()
+			delete(c.revalidating, key)
+			c.revalidatingLock.Unlock()
+			release()
+		}()
+
+		rec := c.record(nil, bg, next, ws, entry)
+		if rec.status == http.StatusNotModified {
+			c.refresh(bg, entry, rec.header)
+			return
+		}
+		c.store(bg, rec)
+		c.logger.Trace("revalidated", key, "with status", rec.status)
+	}()
+	return true
+}
+
+// refresh updates headers and freshness of entry by not modified response header
+func (c *httpCache) refresh(r *http.Request, entry *CachedResponse, header http.Header) *CachedResponse {
+	refreshed := *entry
+	refreshed.Header = entry.Header.Clone()
+	for k, v := range header {
+		if k == "Content-Length" || k == "Content-Type" {
+			continue
+		}
+		refreshed.Header[k] = v
+	}
+	if !c.setFreshness(&refreshed, time.Now()) {
+		return &refreshed
+	}
+
+	_, key := c.lookup(r)
+	c.Store.Set(key, &refreshed)
+	return &refreshed
+}
+
+// store caches recorded response if it is cacheable
+func (c *httpCache) store(r *http.Request, rec *cacheRecorder) {
+	if rec.overflow || rec.stateful || !cacheableStatus[rec.status] || rec.header.Get("Set-Cookie") != "" {
+		return
+	}
+	if r.Header.Get("Authorization") != "" {
+		cc := parseCacheControl(rec.header)
+		if !cc.has("public") && !cc.has("s-maxage") {
+			return
+		}
+	}
+
+	vary := []string{}
+	for _, v := range rec.header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return
+			} else if name != "" {
+				vary = append(vary, name)
+			}
+		}
+	}
+
+	entry := &CachedResponse{
+		Status: rec.status,
+		Header: rec.header.Clone(),
+		Body:   append([]byte(nil), rec.body.Bytes()...),
+		Vary:   vary,
+	}
+	if !c.setFreshness(entry, time.Now()) {
+		return
+	}
+
+	key := cacheKeyPrefix(r.Host, r.URL.RequestURI()) + r.Method
+	if len(vary) > 0 {
+		c.Store.Set(key, &CachedResponse{Vary: vary, StoredAt: entry.StoredAt})
+		key = varyKey(key, vary, r)
+	}
+	c.Store.Set(key, entry)
+	c.logger.Trace("cached", key, "until", entry.Expires)
+}
+
+// setFreshness computes freshness of entry from its header, returns false if it is not cacheable
+func (c *httpCache) setFreshness(entry *CachedResponse, now time.Time) bool {
+	cc := parseCacheControl(entry.Header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+
+	ttl, ok := cc.seconds("s-maxage")
+	if !ok {
+		ttl, ok = cc.seconds("max-age")
+	}
+	if !ok {
+		if expires := entry.Header.Get("Expires"); expires != "" {
+			ok = true
+			if t, err := http.ParseTime(expires); err == nil {
+				date := now
+				if d, err := http.ParseTime(entry.Header.Get("Date")); err == nil {
+					date = d
+				}
+				ttl = t.Sub(date)
+			}
+		}
+	}
+	if !ok {
+		ttl = c.DefaultTTL
+	}
+	if age, err := strconv.ParseInt(entry.Header.Get("Age"), 10, 64); err == nil {
+		ttl -= time.Duration(age) * time.Second
+	}
+	if cc.has("no-cache") {
+		ttl = 0
+	}
+
+	swr, ok := cc.seconds("stale-while-revalidate")
+	if !ok {
+		swr = c.StaleWhileRevalidate
+	}
+	if ttl <= 0 && (!entry.hasValidators() || cc.has("no-cache")) && swr <= 0 {
+		return false
+	}
+
+	entry.StoredAt = now
+	entry.Expires = now.Add(ttl)
+	entry.StaleUntil = entry.Expires.Add(swr)
+	entry.MustRevalidate = cc.has("must-revalidate") || cc.has("proxy-revalidate")
+	return true
+}
+
+// serve responses client with cached response, conditional requests are answered with 304
+func (c *httpCache) serve(w http.ResponseWriter, r *http.Request, entry *CachedResponse, state string) {
+	copyHeader(w.Header(), entry.Header)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.StoredAt).Seconds())))
+	w.Header().Set("X-Cache", state)
+	c.logger.Trace("serve", r.URL.RequestURI(), "from cache with state", state)
+
+	if etag := entry.Header.Get("ETag"); etag != "" && httpHeaderHasToken(r.Header, "If-None-Match", etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && r.Header.Get("If-None-Match") == "" {
+		if lm, err := http.ParseTime(entry.Header.Get("Last-Modified")); err == nil && !lm.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.WriteHeader(entry.Status)
+	if r.Method != "HEAD" {
+		w.Write(entry.Body)
+	}
+}
+
+// cacheRecorder records handler response, it passes response through to client
+// once body exceeds limit or handler flushes
+type cacheRecorder struct {
+	w           http.ResponseWriter
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	limit       int64
+	wroteHeader bool
+	passthrough bool
+	overflow    bool
+	stateful    bool
+}
+
+func (rec *cacheRecorder) Header() http.Header {
+	if rec.passthrough {
+		return rec.w.Header()
+	}
+	return rec.header
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = status
+}
+
+func (rec *cacheRecorder) Write(data []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.passthrough {
+		return rec.w.Write(data)
+	}
+	if rec.overflow {
+		return len(data), nil
+	}
+
+	rec.body.Write(data)
+	if rec.limit > 0 && int64(rec.body.Len()) > rec.limit {
+		rec.startPassthrough()
+	}
+	return len(data), nil
+}
+
+func (rec *cacheRecorder) Flush() {
+	rec.startPassthrough()
+	if f, ok := rec.w.(http.Flusher); ok && rec.passthrough {
+		f.Flush()
+	}
+}
+
+// Unwrap returns client writer, it is nil while revalidating in background
+func (rec *cacheRecorder) Unwrap() http.ResponseWriter {
+	return rec.w
+}
+
+// buffering reports whether response is still recorded rather than passed through
+func (rec *cacheRecorder) buffering() bool {
+	return !rec.overflow
+}
+
+// startPassthrough writes recorded response to client and passes following writes through,
+// recorder without client just drops following writes
+func (rec *cacheRecorder) startPassthrough() {
+	rec.overflow = true
+	if rec.w == nil || rec.passthrough {
+		return
+	}
+
+	rec.passthrough = true
+	copyHeader(rec.w.Header(), rec.header)
+	rec.w.Header().Set("X-Cache", "MISS")
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.w.WriteHeader(rec.status)
+	rec.w.Write(rec.body.Bytes())
+	rec.body.Reset()
+}
+
+// memoryCacheStore is a memory LRU store of cached responses
+type memoryCacheStore struct {
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	lru     *list.List
+	lock    sync.Mutex
+}
+
+type memoryCacheItem struct {
+	key  string
+	resp *CachedResponse
+	size int64
+}
+
+// BuildMemoryCacheStore builds memory LRU cache store limited by maxSize bytes
+func BuildMemoryCacheStore(maxSize int64) CacheStore {
+	return &memoryCacheStore{
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (s *memoryCacheStore) Get(key string) (*CachedResponse, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(e)
+	return e.Value.(*memoryCacheItem).resp, true
+}
+
+func (s *memoryCacheStore) Set(key string, resp *CachedResponse) {
+	item := &memoryCacheItem{key: key, resp: resp, size: int64(len(key)) + resp.size()}
+	if s.maxSize > 0 && item.size > s.maxSize {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		s.removeElement(e)
+	}
+	s.items[key] = s.lru.PushFront(item)
+	s.size += item.size
+	for s.maxSize > 0 && s.size > s.maxSize {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+func (s *memoryCacheStore) Delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		s.removeElement(e)
+	}
+}
+
+func (s *memoryCacheStore) DeletePrefix(prefix string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := 0
+	for k, e := range s.items {
+		if strings.HasPrefix(k, prefix) {
+			s.removeElement(e)
+			count++
+		}
+	}
+	return count
+}
+
+func (s *memoryCacheStore) removeElement(e *list.Element) {
+	item := e.Value.(*memoryCacheItem)
+	s.lru.Remove(e)
+	delete(s.items, item.key)
+	s.size -= item.size
+}
@@ -0,0 +1,198 @@
+package webservice
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPCacheHandler(t *testing.T) {
+	calls := 0
+	handler := func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+		calls++
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte("lang " + r.Header.Get("Accept-Language")))
+		case "/etag":
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+			w.Write([]byte("etag body"))
+		default:
+			return &ServiceResponse{Status: ErrorCodeSuccess, Message: "ok", Data: calls}
+		}
+		return nil
+	}
+
+	conf := BuildCacheConfig()
+	conf.Logger = &logger{level: logLevelError}
+	cache := BuildHTTPCache(conf)
+	cached := cache.Handler(handler)
+	get := func(path, lang string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		r.Header.Set("Accept-Language", lang)
+		w := httptest.NewRecorder()
+		cached(w, r, nil)
+		return w
+	}
+
+	get("/fresh", "en")
+	if w := get("/fresh", "en"); w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "lang en" || calls != 1 {
+		t.Fatalf("fresh response is not served from cache: %v %q %v", w.Header(), w.Body.String(), calls)
+	}
+	if w := get("/fresh", "fr"); w.Body.String() != "lang fr" || calls != 2 {
+		t.Fatalf("vary is not honored: %q", w.Body.String())
+	}
+
+	get("/etag", "en")
+	if w := get("/etag", "en"); w.Header().Get("X-Cache") != "REVALIDATED" || w.Body.String() != "etag body" {
+		t.Fatalf("response is not revalidated: %v %q", w.Header(), w.Body.String())
+	}
+
+	// responses without freshness info are not cached by default
+	get("/json", "en")
+	if w := get("/json", "en"); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("unexpected cache state %v", w.Header().Get("X-Cache"))
+	}
+
+	cache.Purge("example.com", "/fresh")
+	before := calls
+	if get("/fresh", "en"); calls != before+1 {
+		t.Fatalf("purged response is served from cache")
+	}
+}
+
+func TestMemoryCacheStoreEviction(t *testing.T) {
+	store := BuildMemoryCacheStore(40)
+	store.Set("a", &CachedResponse{Status: 200, Body: make([]byte, 15)})
+	store.Set("b", &CachedResponse{Status: 200, Body: make([]byte, 15)})
+	store.Get("a")
+	store.Set("c", &CachedResponse{Status: 200, Body: make([]byte, 15)})
+
+	if _, ok := store.Get("b"); ok {
+		t.Fatalf("least recently used entry is not evicted")
+	}
+	if _, ok := store.Get("a"); !ok {
+		t.Fatalf("recently used entry is evicted")
+	}
+	if n := store.DeletePrefix(""); n != 2 {
+		t.Fatalf("expected 2 entries deleted, got %v", n)
+	}
+}
+
+func TestHTTPCacheStaleRevalidation(t *testing.T) {
+	var calls int32
+	hold := make(chan chan struct{}, 1)
+	entered := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+		select {
+		case unblock := <-hold:
+			entered <- struct{}{}
+			<-unblock
+		default:
+		}
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		w.Write([]byte("page"))
+		return nil
+	}
+	conf := BuildCacheConfig()
+	conf.Logger = &logger{level: logLevelError}
+	limit := BuildConcurrencyLimit(2)
+	limit.MaxQueue = 0
+	ws := buildTestService(map[string]RequestHandlerFunc{"/page": BuildHTTPCache(conf).Handler(handler)})
+	ws.ConcurrencyLimit = limit
+	ws.initRequestLayers()
+
+	do := func(cookie string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/page", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		w := httptest.NewRecorder()
+		ws.dispatch(w, r)
+		return w
+	}
+
+	do("")
+	// handler of requests with session cookie is not run after response
+	if w := do("session=1"); w.Header().Get("X-Cache") != "MISS" || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("stateful request is served stale: %v %v", w.Header(), calls)
+	}
+
+	unblock := make(chan struct{})
+	hold <- unblock
+	if w := do(""); w.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("stateless request is not served stale: %v", w.Header())
+	}
+	<-entered
+	if ws.InFlight() != 1 {
+		t.Fatalf("revalidation is not counted as in flight, got %v", ws.InFlight())
+	}
+	// one slot is left for request, so it is revalidated synchronously
+	if w := do(""); w.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("request is served stale without free slot: %v", w.Header())
+	}
+	close(unblock)
+	for i := 0; ws.InFlight() != 0; i++ {
+		if i == 100 {
+			t.Fatal("revalidation slot is not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHTTPCacheOfRequestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	page := `<script nonce="{{cspNonce}}">run()</script>`
+	if err := ioutil.WriteFile(filepath.Join(dir, "page.html"), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := buildTestService(nil)
+	ws.SecurityHeaders = BuildSecurityHeaders()
+	ws.templatesManager = buildTemplatesManager(dir, "*.html", "", "", ws.Logger)
+	conf := BuildCacheConfig()
+	conf.Logger = &logger{level: logLevelError}
+	cached := BuildHTTPCache(conf).Handler(func(w http.ResponseWriter, r *http.Request, ws WebService) *ServiceResponse {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if err := ws.TemplatesManager().RenderTemplate(w, "page.html", nil); err != nil {
+			t.Error(err)
+		}
+		return nil
+	})
+	handler := ws.withRequestState(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cached(w, r, ws)
+	}))
+
+	// page rendered with nonce of request is not replayed to later requests
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+		csp := w.Header().Get("Content-Security-Policy")
+		start := strings.Index(w.Body.String(), `nonce="`)
+		if w.Header().Get("X-Cache") != "MISS" || start < 0 {
+			t.Fatalf("unexpected response %v %q", w.Header(), w.Body.String())
+		}
+		nonce := strings.SplitN(w.Body.String()[start+len(`nonce="`):], `"`, 2)[0]
+		if nonce == "" || !strings.Contains(csp, "'nonce-"+nonce+"'") {
+			t.Fatalf("nonce %q is not in policy %q", nonce, csp)
+		}
+	}
+}
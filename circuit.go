@@ -0,0 +1,118 @@
+package webservice
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker stops requests to an upstream after consecutive failures,
+// and lets limited probes through after open timeout to check whether it recovers
+type circuitBreaker struct {
+	failures    int
+	openTimeout time.Duration
+	halfOpenMax int
+
+	lock        sync.Mutex
+	state       int
+	consecutive int
+	openedAt    time.Time
+	probes      int
+}
+
+func buildCircuitBreaker(conf *ProxyConfig) *circuitBreaker {
+	halfOpenMax := conf.BreakerHalfOpenRequests
+	if halfOpenMax <= 0 {
+		halfOpenMax = 1
+	}
+	return &circuitBreaker{
+		failures:    conf.BreakerFailures,
+		openTimeout: conf.BreakerOpenTimeout,
+		halfOpenMax: halfOpenMax,
+	}
+}
+
+// ready checks whether breaker would allow a request without changing its state
+func (cb *circuitBreaker) ready(now time.Time) bool {
+	if cb == nil || cb.failures <= 0 {
+		return true
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		return now.Sub(cb.openedAt) >= cb.openTimeout
+	case circuitHalfOpen:
+		return cb.probes < cb.halfOpenMax
+	}
+	return true
+}
+
+// allow checks whether a request is allowed, allowed requests must be reported
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	if cb == nil || cb.failures <= 0 {
+		return true
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.state == circuitOpen {
+		if now.Sub(cb.openedAt) < cb.openTimeout {
+			return false
+		}
+		cb.state = circuitHalfOpen
+		cb.probes = 0
+	}
+	if cb.state == circuitHalfOpen {
+		if cb.probes >= cb.halfOpenMax {
+			return false
+		}
+		cb.probes++
+	}
+	return true
+}
+
+// report records result of an allowed request
+func (cb *circuitBreaker) report(failed bool) {
+	if cb == nil || cb.failures <= 0 {
+		return
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if !failed {
+		cb.consecutive = 0
+		cb.state = circuitClosed
+		return
+	}
+
+	cb.consecutive++
+	if cb.state == circuitHalfOpen || cb.consecutive >= cb.failures {
+		cb.state = circuitOpen
+		cb.openedAt = time.Now()
+		cb.consecutive = 0
+	}
+}
+
+// finish reports result of an allowed attempt, aborted attempt gives its half open probe back
+func (cb *circuitBreaker) finish(result attemptResult) {
+	if result != attemptAborted {
+		cb.report(result == attemptFailed)
+		return
+	}
+	if cb == nil || cb.failures <= 0 {
+		return
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.state == circuitHalfOpen && cb.probes > 0 {
+		cb.probes--
+	}
+}
@@ -0,0 +1,260 @@
+package webservice
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyLimit stores a max in-flight requests rule
+type ConcurrencyLimit struct {
+	// MaxInFlight is count of requests handled at the same time
+	MaxInFlight int
+	// MaxQueue is count of requests waiting for a slot, zero means rejecting immediately
+	MaxQueue int
+	// QueueTimeout rejects requests waiting longer, zero means waiting until request is canceled
+	QueueTimeout time.Duration
+	// Adaptive lowers limit down to MinInFlight while average latency exceeds TargetLatency,
+	// and raises it back up to MaxInFlight while latency recovers
+	Adaptive      bool
+	MinInFlight   int
+	TargetLatency time.Duration
+	// RetryAfter is sent with rejected requests
+	RetryAfter time.Duration
+}
+
+// BuildConcurrencyLimit builds a default concurrency limit of max in-flight requests
+func BuildConcurrencyLimit(maxInFlight int) *ConcurrencyLimit {
+	return &ConcurrencyLimit{
+		MaxInFlight:   maxInFlight,
+		MaxQueue:      maxInFlight,
+		QueueTimeout:  time.Second,
+		MinInFlight:   1,
+		TargetLatency: time.Second,
+		RetryAfter:    time.Second,
+	}
+}
+
+// concurrencyLimiter limits in-flight requests, waiters are handed slots in order
+type concurrencyLimiter struct {
+	ConcurrencyLimit
+	lock     sync.Mutex
+	inFlight int
+	limit    float64
+	latency  time.Duration
+	waiters  []chan struct{}
+}
+
+func buildConcurrencyLimiter(conf *ConcurrencyLimit) *concurrencyLimiter {
+	l := &concurrencyLimiter{ConcurrencyLimit: *conf, limit: float64(conf.MaxInFlight)}
+	if l.MinInFlight <= 0 || l.MinInFlight > l.MaxInFlight {
+		l.MinInFlight = 1
+	}
+	return l
+}
+
+// acquire takes a slot, it waits in queue if all slots are taken
+func (l *concurrencyLimiter) acquire(ctx context.Context) bool {
+	l.lock.Lock()
+	if l.inFlight < int(l.limit) {
+		l.inFlight++
+		l.lock.Unlock()
+		return true
+	}
+	if len(l.waiters) >= l.MaxQueue {
+		l.lock.Unlock()
+		return false
+	}
+	// buffered so that release never blocks on handing slot
+	ch := make(chan struct{}, 1)
+	l.waiters = append(l.waiters, ch)
+	l.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if l.QueueTimeout > 0 {
+		timer := time.NewTimer(l.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return true
+	case <-timeout:
+	case <-ctx.Done():
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i, waiter := range l.waiters {
+		if waiter == ch {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return false
+		}
+	}
+	// slot was handed while timing out
+	return true
+}
+
+// release returns slot taken by a request which was handled in latency
+func (l *concurrencyLimiter) release(latency time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// latency is zero for slots returned without handling request
+	if l.Adaptive && latency > 0 {
+		l.adapt(latency)
+	}
+	if len(l.waiters) > 0 && l.inFlight <= int(l.limit) {
+		ch := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		ch <- struct{}{}
+		return
+	}
+	l.inFlight--
+}
+
+// adapt updates moving average of latency, limit decreases multiplicatively while it is
+// above target and increases additively by about one slot per limit requests otherwise
+func (l *concurrencyLimiter) adapt(latency time.Duration) {
+	if l.latency == 0 {
+		l.latency = latency
+	} else {
+		l.latency = (l.latency*9 + latency) / 10
+	}
+
+	if l.TargetLatency > 0 && l.latency > l.TargetLatency {
+		l.limit = math.Max(float64(l.MinInFlight), l.limit*0.9)
+	} else {
+		l.limit = math.Min(float64(l.MaxInFlight), l.limit+1/l.limit)
+	}
+}
+
+// concurrency stores in-flight counters and limiters of web service
+type concurrency struct {
+	inFlight      int64
+	routeInFlight map[string]*int64
+	limiter       *concurrencyLimiter
+	routeLimiters map[string]*concurrencyLimiter
+}
+
+func buildConcurrency(conf *Config) *concurrency {
+	c := &concurrency{
+		routeInFlight: make(map[string]*int64, len(conf.Handlers)),
+		routeLimiters: make(map[string]*concurrencyLimiter, len(conf.RouteConcurrencyLimits)),
+	}
+	for route := range conf.Handlers {
+		c.routeInFlight[route] = new(int64)
+	}
+	if conf.ConcurrencyLimit != nil && conf.ConcurrencyLimit.MaxInFlight > 0 {
+		c.limiter = buildConcurrencyLimiter(conf.ConcurrencyLimit)
+	}
+	for route, limit := range conf.RouteConcurrencyLimits {
+		if limit != nil && limit.MaxInFlight > 0 {
+			c.routeLimiters[route] = buildConcurrencyLimiter(limit)
+		}
+	}
+	return c
+}
+
+func (ws *webService) InFlight() int64 {
+	if ws.concurrency == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&ws.concurrency.inFlight)
+}
+
+func (ws *webService) RouteInFlight(route string) int64 {
+	if ws.concurrency == nil {
+		return 0
+	}
+	if counter, ok := ws.concurrency.routeInFlight[route]; ok {
+		return atomic.LoadInt64(counter)
+	}
+	return 0
+}
+
+// checkConcurrency counts request as in flight and takes slots of global and route limiters,
+// the returned function must be called after request is handled if request is not rejected
+func (ws *webService) checkConcurrency(route string, w http.ResponseWriter, r *http.Request) (func(), *ServiceResponse) {
+	release, rejected := ws.acquireConcurrency(r.Context(), route)
+	if rejected != nil {
+		return nil, overloadedResponse(w, rejected.RetryAfter)
+	}
+	return release, nil
+}
+
+// tryConcurrency takes slots of global and route limiters for work done after response without
+// waiting in queue, it returns nil if slots are not available
+func (ws *webService) tryConcurrency(route string) func() {
+	// limiters only hand free slots to a canceled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	release, rejected := ws.acquireConcurrency(ctx, route)
+	if rejected != nil {
+		return nil
+	}
+	return release
+}
+
+// acquireConcurrency counts work as in flight and takes slots of global and route limiters,
+// it returns the rejecting limiter if a slot is not taken before ctx is done
+func (ws *webService) acquireConcurrency(ctx context.Context, route string) (func(), *concurrencyLimiter) {
+	c := ws.concurrency
+	if c == nil {
+		return func() {}, nil
+	}
+
+	atomic.AddInt64(&c.inFlight, 1)
+	counter := c.routeInFlight[route]
+	if counter != nil {
+		atomic.AddInt64(counter, 1)
+	}
+	done := func() {
+		atomic.AddInt64(&c.inFlight, -1)
+		if counter != nil {
+			atomic.AddInt64(counter, -1)
+		}
+	}
+
+	var taken []*concurrencyLimiter
+	for _, limiter := range []*concurrencyLimiter{c.limiter, c.routeLimiters[route]} {
+		if limiter == nil {
+			continue
+		}
+		if !limiter.acquire(ctx) {
+			for _, l := range taken {
+				l.release(0)
+			}
+			done()
+			return nil, limiter
+		}
+		taken = append(taken, limiter)
+	}
+
+	start := time.Now()
+	return func() {
+		latency := time.Since(start)
+		for _, l := range taken {
+			l.release(latency)
+		}
+		done()
+	}, nil
+}
+
+// overloadedResponse builds 503 response of rejected request
+func overloadedResponse(w http.ResponseWriter, retryAfter time.Duration) *ServiceResponse {
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	return &ServiceResponse{
+		Status:  http.StatusServiceUnavailable,
+		Message: "service is overloaded",
+		Data:    map[int]int{},
+	}
+}
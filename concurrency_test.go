@@ -0,0 +1,78 @@
+package webservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDispatchConcurrencyLimit(t *testing.T) {
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+		entered <- struct{}{}
+		<-unblock
+		return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+	}
+	limit := BuildConcurrencyLimit(1)
+	limit.MaxQueue = 0
+	ws := buildTestService(map[string]RequestHandlerFunc{"/slow": handler})
+	ws.RouteConcurrencyLimits = map[string]*ConcurrencyLimit{"/slow": limit}
+	ws.initRequestLayers()
+
+	do := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/slow", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		ws.dispatch(w, r)
+		return w
+	}
+
+	first := make(chan int)
+	go func() { first <- do().Code }()
+	<-entered
+	if ws.InFlight() != 1 || ws.RouteInFlight("/slow") != 1 {
+		t.Fatalf("unexpected in-flight counts %v %v", ws.InFlight(), ws.RouteInFlight("/slow"))
+	}
+
+	w := do()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 503 with Retry-After, got %v %v", w.Code, w.Header())
+	}
+
+	close(unblock)
+	if code := <-first; code != http.StatusOK {
+		t.Fatalf("unexpected status of first request %v", code)
+	}
+	if ws.InFlight() != 0 {
+		t.Fatalf("in-flight count is not released, got %v", ws.InFlight())
+	}
+}
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	limit := BuildConcurrencyLimit(1)
+	limit.QueueTimeout = time.Second
+	l := buildConcurrencyLimiter(limit)
+
+	if !l.acquire(context.Background()) {
+		t.Fatal("first request is rejected")
+	}
+	acquired := make(chan bool)
+	go func() { acquired <- l.acquire(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	l.release(time.Millisecond)
+	if !<-acquired {
+		t.Fatal("queued request is not handed the released slot")
+	}
+
+	limit.QueueTimeout = 20 * time.Millisecond
+	l.QueueTimeout = limit.QueueTimeout
+	if l.acquire(context.Background()) {
+		t.Fatal("expected queued request to time out")
+	}
+	if len(l.waiters) != 0 {
+		t.Fatalf("timed out waiter is not removed")
+	}
+}
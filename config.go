@@ -1,6 +1,7 @@
 package webservice
 
 import (
+	"crypto/tls"
 	"path/filepath"
 	"time"
 )
@@ -24,6 +25,64 @@ type Config struct {
 	TLSCert                  string
 	TLSKey                   string
 	UploadsDir               string
+	// TLSCertificates are served in addition to TLSCert/TLSKey, certificate is selected by sni,
+	// the first certificate is default one. Certificates are reloaded while their files change
+	TLSCertificates []TLSCertificate
+	// TLSMinVersion and TLSCipherSuites are passed to tls.Config, zero values mean defaults of crypto/tls
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+	// TLSDisableHTTP2 disables http/2 negotiated by alpn
+	TLSDisableHTTP2 bool
+	// ClientAuth authenticates clients by tls client certificates, it is disabled if it is nil
+	ClientAuth *ClientAuthConfig
+	// ACME obtains certificates of hosts from acme ca, it is disabled if it is nil
+	ACME *ACMEConfig
+	// Listeners replace listener of WebAddr and Port, which serves https if there are certificates
+	Listeners []ListenerConfig
+	// HTTPSRedirectAddr redirects plain http requests on it to the first tls listener if it is not empty
+	HTTPSRedirectAddr string
+	// H2C serves http/2 cleartext with prior knowledge on plain listeners
+	H2C bool
+	// HTTP3 serves http/3 over udp on address of the first tls listener and advertises it by Alt-Svc,
+	// it is disabled if it is nil. Server of github.com/lucifinil-long/webservice/http3 implements it
+	HTTP3 HTTP3Server
+	// StaticFiles mounts static file handlers by path prefix like Statics, which mounts directories
+	// with default StaticConfig
+	StaticFiles map[string]*StaticConfig
+	// RootFiles serves single files on root paths such as /favicon.ico and /robots.txt, keyed by url path,
+	// other files of working directory are never served
+	RootFiles map[string]*RootFile
+	// MaxBodySize limits bytes of request body, zero means no limit and is the default,
+	// upload handlers limit their bodies by their own configs
+	MaxBodySize int64
+	// RouteMaxBodySizes overrides MaxBodySize for routes of Handlers
+	RouteMaxBodySizes map[string]int64
+	// RouteSignatures requires signed requests for routes of Handlers
+	RouteSignatures map[string]SignatureVerifier
+	// RateLimit limits all requests, RouteRateLimits limits requests of routes of Handlers in addition
+	RateLimit       *RateLimit
+	RouteRateLimits map[string]*RateLimit
+	// RateLimitStore stores rate limit states, rate limits are disabled if it is nil
+	RateLimitStore RateLimitStore
+	// ConcurrencyLimit limits all in-flight requests,
+	// RouteConcurrencyLimits limits in-flight requests of routes of Handlers in addition
+	ConcurrencyLimit       *ConcurrencyLimit
+	RouteConcurrencyLimits map[string]*ConcurrencyLimit
+	// ReadHeaderTimeout, IdleTimeout and MaxHeaderBytes are passed to http.Server,
+	// zero values mean defaults of http.Server
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	// HandlerTimeout cancels context of request and responds service unavailable
+	// if handler overruns it, RouteTimeouts overrides it for routes of Handlers
+	HandlerTimeout time.Duration
+	RouteTimeouts  map[string]time.Duration
+	// SecurityHeaders are added to all responses, they are disabled if it is nil
+	SecurityHeaders *SecurityHeaders
+	// CSRF protects routes against cross site request forgery, it is disabled if it is nil
+	CSRF *CSRFConfig
+	// Sessions enables sessions of handlers and templates, they are disabled if it is nil
+	Sessions *SessionConfig
 }
 
 // BuildConfig builds a default http config which can be convert to https config easy
@@ -41,6 +100,14 @@ func BuildConfig() *Config {
 		Logger:                   &logger{},
 		Pprof:                    true,
 		UploadsDir:               filepath.Join(getCurrentDirectory(), "uploads"),
+		RateLimitStore:           BuildMemoryRateLimitStore(),
+		ReadHeaderTimeout:        10 * time.Second,
+		IdleTimeout:              2 * time.Minute,
+		MaxHeaderBytes:           1 << 20,
+		TLSMinVersion:            tls.VersionTLS12,
+		RootFiles: map[string]*RootFile{
+			"/favicon.ico": {Path: filepath.Join(getCurrentDirectory(), "favicon.ico"), CacheControl: "public, max-age=86400"},
+		},
 	}
 }
 
@@ -59,3 +126,141 @@ func (conf *Config) SetLogger(log interface{}) {
 		conf.Logger = l
 	}
 }
+
+// ProxyConfig stores http proxy config
+type ProxyConfig struct {
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ExpectContinueTimeout time.Duration
+	ResponseHeaderTimeout time.Duration
+	// InsecureSkipVerify disables upstream certificate verification, only for testing
+	InsecureSkipVerify bool
+	// RootCAs lists PEM files of CAs trusted in addition to system roots
+	RootCAs []string
+	// FlushInterval is the interval to flush response body to client,
+	// negative value means flush after each write
+	FlushInterval time.Duration
+	// PreserveHost forwards Host header of incoming request instead of target host
+	PreserveHost bool
+	// Timeout limits waiting for upstream response headers, zero means no limit
+	Timeout time.Duration
+	// Retries is max retry times of idempotent requests failed or responded 502/503/504
+	Retries      int
+	RetryBackoff time.Duration
+	// MaxRetryBodySize is max request body size buffered for retries,
+	// requests with larger body are not retried
+	MaxRetryBodySize int64
+	// BreakerFailures consecutive failures open circuit breaker of an upstream, zero disables it
+	BreakerFailures int
+	// BreakerOpenTimeout is duration before an open breaker lets probes through
+	BreakerOpenTimeout time.Duration
+	// BreakerHalfOpenRequests is max probes allowed by a half-open breaker
+	BreakerHalfOpenRequests int
+	Logger                  Logger
+}
+
+// BuildProxyConfig builds a default http proxy config
+func BuildProxyConfig() *ProxyConfig {
+	return &ProxyConfig{
+		DialTimeout:             30 * time.Second,
+		KeepAlive:               30 * time.Second,
+		MaxIdleConns:            100,
+		MaxIdleConnsPerHost:     100,
+		IdleConnTimeout:         90 * time.Second,
+		TLSHandshakeTimeout:     10 * time.Second,
+		ExpectContinueTimeout:   1 * time.Second,
+		Timeout:                 60 * time.Second,
+		Retries:                 2,
+		RetryBackoff:            100 * time.Millisecond,
+		MaxRetryBodySize:        1 << 20,
+		BreakerFailures:         5,
+		BreakerOpenTimeout:      30 * time.Second,
+		BreakerHalfOpenRequests: 1,
+		Logger:                  &logger{},
+	}
+}
+
+// UpstreamTarget defines one target of upstream pool
+type UpstreamTarget struct {
+	URL string
+	// Weight is used by weighted and hash balancing, defaults to 1
+	Weight int
+}
+
+// UpstreamPoolConfig stores upstream pool config
+type UpstreamPoolConfig struct {
+	Name    string
+	Targets []UpstreamTarget
+	// Balance is one of BalanceRoundRobin, BalanceWeighted, BalanceLeastConn and BalanceHash
+	Balance string
+	// HashHeader and HashCookie select the key of BalanceHash, client ip is used if both are absent
+	HashHeader string
+	HashCookie string
+	// HealthCheckPath enables active health check if it is not empty
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	// MaxFails consecutive failures eject target for FailTimeout, zero disables passive ejection
+	MaxFails    int
+	FailTimeout time.Duration
+}
+
+// BuildUpstreamPoolConfig builds a default round-robin upstream pool config
+func BuildUpstreamPoolConfig(name string, targets ...string) *UpstreamPoolConfig {
+	conf := &UpstreamPoolConfig{
+		Name:                name,
+		Balance:             BalanceRoundRobin,
+		HealthCheckInterval: 10 * time.Second,
+		HealthCheckTimeout:  2 * time.Second,
+		MaxFails:            3,
+		FailTimeout:         30 * time.Second,
+	}
+	for _, t := range targets {
+		conf.Targets = append(conf.Targets, UpstreamTarget{URL: t, Weight: 1})
+	}
+	return conf
+}
+
+// ProxyRoute defines a route which forwards requests to an upstream pool
+type ProxyRoute struct {
+	// Pool is name of upstream pool added by HTTPProxy.AddUpstreamPool
+	Pool string
+	// StripPrefix is removed from request path before it is joined with target url
+	StripPrefix string
+	// Timeout overrides ProxyConfig.Timeout if it is positive
+	Timeout time.Duration
+	// Retries overrides ProxyConfig.Retries if it is positive, negative value disables retries
+	Retries int
+	// Rewrite defines rewriting of forwarded requests and their responses
+	Rewrite *RewriteRules
+	// Cache caches upstream responses of the route if it is not nil
+	Cache HTTPCache
+}
+
+// CacheConfig stores http cache config
+type CacheConfig struct {
+	// Store defaults to a memory LRU store limited by MaxSize
+	Store CacheStore
+	// MaxSize is max bytes of default memory store
+	MaxSize int64
+	// MaxEntrySize is max body bytes of a cacheable response
+	MaxEntrySize int64
+	// DefaultTTL is freshness of responses without explicit expiration, zero means not cached
+	DefaultTTL time.Duration
+	// StaleWhileRevalidate is used when responses do not specify stale-while-revalidate
+	StaleWhileRevalidate time.Duration
+	Logger               Logger
+}
+
+// BuildCacheConfig builds a default http cache config
+func BuildCacheConfig() *CacheConfig {
+	return &CacheConfig{
+		MaxSize:      64 << 20,
+		MaxEntrySize: 1 << 20,
+		Logger:       &logger{},
+	}
+}
@@ -0,0 +1,367 @@
+package webservice
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CSRFDoubleSubmit keeps signed token in cookie, request must send the same token
+	CSRFDoubleSubmit = "double-submit"
+	// CSRFSynchronizer keeps token in store keyed by cookie, request must send the stored token
+	CSRFSynchronizer = "synchronizer"
+)
+
+// CSRFConfig stores csrf protection config
+type CSRFConfig struct {
+	Mode string
+	// Secret signs double submit tokens, a random secret is used if it is empty
+	Secret         []byte
+	CookieName     string
+	CookiePath     string
+	CookieDomain   string
+	CookieSecure   bool
+	CookieSameSite http.SameSite
+	MaxAge         time.Duration
+	// HeaderName and FormField carry token sent by client, header is checked first
+	HeaderName string
+	FormField  string
+	// Routes lists routes of Handlers whose unsafe requests are verified,
+	// requests authenticated by signature are exempted since browsers never sign them
+	Routes []string
+	// Store keeps tokens of synchronizer mode
+	Store CSRFStore
+	// Body limits body read for form field
+	Body *BodyConfig
+}
+
+// BuildCSRFConfig builds a default double submit csrf config protecting routes
+func BuildCSRFConfig(secret []byte, routes ...string) *CSRFConfig {
+	return &CSRFConfig{
+		Mode:           CSRFDoubleSubmit,
+		Secret:         secret,
+		CookieName:     "csrf_token",
+		CookiePath:     "/",
+		CookieSameSite: http.SameSiteLaxMode,
+		MaxAge:         12 * time.Hour,
+		HeaderName:     "X-CSRF-Token",
+		FormField:      "csrf_token",
+		Routes:         routes,
+		Store:          BuildMemoryCSRFStore(),
+		Body:           BuildBodyConfig(),
+	}
+}
+
+// CSRFStore defines storage interface of synchronizer tokens
+type CSRFStore interface {
+	Get(id string) (string, bool)
+	Set(id, token string, ttl time.Duration)
+}
+
+// CSRFTokenFromRequest returns csrf token of request, it is empty if csrf protection is disabled.
+// Token is issued with cookie at first call if client has none, so it must be called before
+// response header is written
+func CSRFTokenFromRequest(r *http.Request) string {
+	return requestStateFromRequest(r).csrfToken()
+}
+
+// csrfHolder issues csrf token of request lazily,
+// so that requests never asking for token get no cookie and store nothing
+type csrfHolder struct {
+	lock   sync.Mutex
+	c      *csrfProtector
+	w      http.ResponseWriter
+	r      *http.Request
+	token  string
+	issued bool
+}
+
+func (h *csrfHolder) get() string {
+	if h == nil {
+		return ""
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.issued {
+		token, err := h.c.token(h.w, h.r)
+		if err != nil {
+			h.c.logger.Error("issue csrf token failed with", err)
+		}
+		h.token, h.issued = token, true
+	}
+	return h.token
+}
+
+// setWriter sets writer which token cookie is set to, it returns the previous one
+func (h *csrfHolder) setWriter(w http.ResponseWriter) http.ResponseWriter {
+	if h == nil {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	prev := h.w
+	h.w = w
+	return prev
+}
+
+type csrfProtector struct {
+	CSRFConfig
+	routes map[string]bool
+	logger Logger
+}
+
+func buildCSRFProtector(conf *CSRFConfig, log Logger) (*csrfProtector, error) {
+	c := &csrfProtector{
+		CSRFConfig: *conf,
+		routes:     make(map[string]bool, len(conf.Routes)),
+		logger:     ConvertLoggerMust(log),
+	}
+	for _, route := range conf.Routes {
+		c.routes[route] = true
+	}
+	if c.Mode == "" {
+		c.Mode = CSRFDoubleSubmit
+	}
+	if c.Mode == CSRFSynchronizer && c.Store == nil {
+		c.Store = BuildMemoryCSRFStore()
+	}
+	if len(c.Secret) == 0 {
+		c.Secret = make([]byte, 32)
+		if _, err := rand.Read(c.Secret); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// current returns token of client kept by cookie, it is empty if client has none
+func (c *csrfProtector) current(r *http.Request) string {
+	cookie, err := r.Cookie(c.CookieName)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	if c.Mode == CSRFSynchronizer {
+		token, _ := c.Store.Get(cookie.Value)
+		return token
+	}
+	if c.validSigned(cookie.Value) {
+		return cookie.Value
+	}
+	return ""
+}
+
+// token returns token of client, a new token is issued with cookie if client has none
+func (c *csrfProtector) token(w http.ResponseWriter, r *http.Request) (string, error) {
+	if token := c.current(r); token != "" {
+		return token, nil
+	}
+
+	if c.Mode == CSRFSynchronizer {
+		id, err := randomNonce()
+		if err != nil {
+			return "", err
+		}
+		token, err := randomNonce()
+		if err != nil {
+			return "", err
+		}
+		ttl := c.MaxAge
+		if ttl <= 0 {
+			// session cookie, keep token for a day
+			ttl = 24 * time.Hour
+		}
+		c.Store.Set(id, token, ttl)
+		c.setCookie(w, id)
+		return token, nil
+	}
+
+	raw, err := randomNonce()
+	if err != nil {
+		return "", err
+	}
+	token := raw + "." + c.sign(raw)
+	c.setCookie(w, token)
+	return token, nil
+}
+
+func (c *csrfProtector) setCookie(w http.ResponseWriter, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.CookieName,
+		Value:    value,
+		Path:     c.CookiePath,
+		Domain:   c.CookieDomain,
+		MaxAge:   int(c.MaxAge / time.Second),
+		Secure:   c.CookieSecure,
+		HttpOnly: true,
+		SameSite: c.CookieSameSite,
+	})
+}
+
+func (c *csrfProtector) sign(raw string) string {
+	mac := hmac.New(sha256.New, c.Secret)
+	mac.Write([]byte(raw))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSigned checks double submit token is signed by secret so that cookies planted
+// by sibling domains are not accepted
+func (c *csrfProtector) validSigned(token string) bool {
+	i := strings.LastIndex(token, ".")
+	return i > 0 && hmac.Equal([]byte(token[i+1:]), []byte(c.sign(token[:i])))
+}
+
+// exempted checks whether request needs no verification
+func (c *csrfProtector) exempted(route string, r *http.Request) bool {
+	if !c.routes[route] {
+		return true
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	// principals of client certificates are not exempted, browsers send certificates by themselves
+	p := PrincipalFromRequest(r)
+	return p != nil && p.Scheme == PrincipalSchemeSignature
+}
+
+// submitted returns token sent by client in header or form field,
+// body is read on a copy of request so that handler can still read it
+func (c *csrfProtector) submitted(r *http.Request) (string, error) {
+	if c.HeaderName != "" {
+		if token := r.Header.Get(c.HeaderName); token != "" {
+			return token, nil
+		}
+	}
+	if c.FormField == "" {
+		return "", nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data" {
+		return "", nil
+	}
+	body, err := ReadBody(r, c.Body, c.logger)
+	if err != nil {
+		return "", err
+	}
+
+	form := new(http.Request)
+	*form = *r
+	form.Form, form.PostForm, form.MultipartForm = nil, nil, nil
+	form.Body = ioutil.NopCloser(body.Reader())
+	if mediaType == "multipart/form-data" {
+		err = form.ParseMultipartForm(1 << 20)
+		if form.MultipartForm != nil {
+			form.MultipartForm.RemoveAll()
+		}
+	} else {
+		err = form.ParseForm()
+	}
+	rewindBody(r)
+	if err != nil {
+		return "", ErrorMalformedBody
+	}
+	return form.PostForm.Get(c.FormField), nil
+}
+
+// verify compares token sent by client with token of client
+func (c *csrfProtector) verify(r *http.Request) error {
+	token := c.current(r)
+	if token == "" {
+		return ErrorInvalidCSRFToken
+	}
+	submitted, err := c.submitted(r)
+	if err != nil {
+		return err
+	}
+	if submitted == "" || subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) != 1 {
+		return ErrorInvalidCSRFToken
+	}
+	return nil
+}
+
+// checkCSRF verifies unsafe requests of protected routes, the returned request carries token
+// issued lazily for templates and CSRFTokenFromRequest
+func (ws *webService) checkCSRF(route string, w http.ResponseWriter, r *http.Request) (*http.Request, *ServiceResponse) {
+	c := ws.csrf
+	if c == nil {
+		return r, nil
+	}
+
+	state := requestStateFromRequest(r)
+	if state == nil {
+		state = &requestState{}
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyRequestState, state))
+	}
+	state.csrf = &csrfHolder{c: c, w: w, r: r}
+	state.csrfField = c.FormField
+
+	if c.exempted(route, r) {
+		return r, nil
+	}
+	if err := c.verify(r); err != nil {
+		ws.Logger.Warn("webService", "checkCSRF", route, "failed with", err)
+		if err != ErrorInvalidCSRFToken {
+			return r, BodyErrorResponse(err)
+		}
+		return r, &ServiceResponse{
+			Status:  http.StatusForbidden,
+			Message: "invalid csrf token",
+			Data:    map[int]int{},
+		}
+	}
+	return r, nil
+}
+
+// memoryCSRFStore stores synchronizer tokens in memory, expired tokens are swept while setting
+type memoryCSRFStore struct {
+	lock      sync.Mutex
+	tokens    map[string]csrfStoreEntry
+	lastSweep time.Time
+}
+
+type csrfStoreEntry struct {
+	token   string
+	expires time.Time
+}
+
+// BuildMemoryCSRFStore builds a csrf store keeping tokens in memory
+func BuildMemoryCSRFStore() CSRFStore {
+	return &memoryCSRFStore{tokens: make(map[string]csrfStoreEntry, 1024), lastSweep: time.Now()}
+}
+
+func (s *memoryCSRFStore) Get(id string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, ok := s.tokens[id]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.token, true
+}
+
+func (s *memoryCSRFStore) Set(id, token string, ttl time.Duration) {
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, entry := range s.tokens {
+			if now.After(entry.expires) {
+				delete(s.tokens, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.tokens[id] = csrfStoreEntry{token: token, expires: now.Add(ttl)}
+}
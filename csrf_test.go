@@ -0,0 +1,118 @@
+package webservice
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDispatchCSRF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	page := `<form method="post">{{csrfField}}</form>`
+	if err := ioutil.WriteFile(filepath.Join(dir, "form.html"), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var posted string
+	ws := buildTestService(map[string]RequestHandlerFunc{
+		"/admin/": func(w http.ResponseWriter, r *http.Request, s WebService) *ServiceResponse {
+			if r.Method == "GET" {
+				s.TemplatesManager().RenderTemplate(w, "form.html", nil)
+				return nil
+			}
+			posted = r.PostFormValue("name")
+			return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+		},
+	})
+	ws.CSRF = BuildCSRFConfig([]byte("secret"), "/admin/")
+	ws.templatesManager = buildTemplatesManager(dir, "*.html", "", "", ws.Logger)
+	ws.initRequestLayers()
+	handler := ws.withRequestState(http.HandlerFunc(ws.dispatch))
+
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	post := func(form url.Values, cookie *http.Cookie) *http.Request {
+		r := httptest.NewRequest("POST", "/admin/users", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		return r
+	}
+
+	w := do(httptest.NewRequest("GET", "/admin/users", nil))
+	cookies := w.Result().Cookies()
+	match := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if len(cookies) != 1 || match == nil || match[1] != cookies[0].Value {
+		t.Fatalf("token is not issued, cookies %v body %q", cookies, w.Body.String())
+	}
+
+	if w := do(post(url.Values{"name": {"eve"}}, cookies[0])); w.Code != http.StatusForbidden {
+		t.Fatalf("expected request without token to be rejected, got %v", w.Code)
+	}
+	if w := do(post(url.Values{"name": {"eve"}, "csrf_token": {match[1]}}, nil)); w.Code != http.StatusForbidden {
+		t.Fatalf("expected request without cookie to be rejected, got %v", w.Code)
+	}
+	if w := do(post(url.Values{"name": {"bob"}, "csrf_token": {match[1]}}, cookies[0])); w.Code != http.StatusOK || posted != "bob" {
+		t.Fatalf("expected valid request to be handled, got %v with %q", w.Code, posted)
+	}
+
+	// header alone is not authentication
+	r := post(url.Values{"name": {"api"}}, nil)
+	r.Header.Set("Authorization", "Bearer token")
+	if w := do(r); w.Code != http.StatusForbidden {
+		t.Fatalf("expected request with unverified header to be rejected, got %v", w.Code)
+	}
+	r = post(url.Values{"name": {"api"}}, nil)
+	if !ws.csrf.exempted("/admin/", withPrincipal(r, &Principal{ID: "api", Scheme: PrincipalSchemeSignature})) {
+		t.Fatal("expected signed request to be exempted")
+	}
+	if ws.csrf.exempted("/admin/", withPrincipal(r, &Principal{ID: "api", Scheme: PrincipalSchemeClientCertificate})) {
+		t.Fatal("expected request of client certificate to be verified")
+	}
+}
+
+func TestCSRFTokenIssuedLazily(t *testing.T) {
+	store := BuildMemoryCSRFStore().(*memoryCSRFStore)
+	var token string
+	ws := buildTestService(map[string]RequestHandlerFunc{
+		"/api": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+		},
+		"/form": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			token = CSRFTokenFromRequest(r)
+			return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+		},
+	})
+	ws.CSRF = BuildCSRFConfig(nil, "/form")
+	ws.CSRF.Mode = CSRFSynchronizer
+	ws.CSRF.Store = store
+	ws.initRequestLayers()
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		ws.dispatch(w, httptest.NewRequest("GET", "/api", nil))
+		if len(w.Result().Cookies()) != 0 || len(store.tokens) != 0 {
+			t.Fatal("token is issued for request not asking for it", w.Result().Cookies(), len(store.tokens))
+		}
+	}
+	w := httptest.NewRecorder()
+	ws.dispatch(w, httptest.NewRequest("GET", "/form", nil))
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || token == "" || len(store.tokens) != 1 {
+		t.Fatal("token is not issued", cookies, token)
+	}
+}
@@ -10,6 +10,26 @@ const (
 	ErrorCodeSuccess = 1
 )
 
+const (
+	// BalanceRoundRobin selects upstream targets in turn
+	BalanceRoundRobin = "round-robin"
+	// BalanceWeighted selects upstream targets in turn by their weights
+	BalanceWeighted = "weighted"
+	// BalanceLeastConn selects upstream target with least in-flight requests
+	BalanceLeastConn = "least-conn"
+	// BalanceHash selects upstream target by consistent hash of header, cookie or client ip
+	BalanceHash = "hash"
+)
+
+// contextKey defines keys of values stored in request context
+type contextKey int
+
+const (
+	contextKeyResumableUpload contextKey = iota
+	contextKeyPrincipal
+	contextKeyRequestState
+)
+
 // ServiceResponse defines union web service response
 type ServiceResponse struct {
 	Status     int         `json:"status"`
@@ -41,8 +61,46 @@ var (
 	ErrorNotFound = errors.New("not found")
 	// ErrorWrongMethod defines wrong method method error
 	ErrorWrongMethod = errors.New("wrong method")
-	// ErrorParsedYet defines parsed error
+	// ErrorParsedYet defines parsed error, it is not returned by GetDataBody any more
 	ErrorParsedYet = errors.New("request has parsed by others")
 	// ErrorInvalidArgument defines invalid argument
 	ErrorInvalidArgument = errors.New("invalid argument")
+	// ErrorNoUpstream defines no available upstream error
+	ErrorNoUpstream = errors.New("no available upstream")
+	// ErrorCircuitOpen defines upstream circuit breaker is open error
+	ErrorCircuitOpen = errors.New("upstream circuit breaker is open")
+	// ErrorUpstreamTimeout defines upstream response timeout error
+	ErrorUpstreamTimeout = errors.New("upstream response timeout")
+	// ErrorUploadTooLarge defines upload exceeds size limit error
+	ErrorUploadTooLarge = errors.New("upload is too large")
+	// ErrorUploadTypeNotAllowed defines upload type is not allowed error
+	ErrorUploadTypeNotAllowed = errors.New("upload type is not allowed")
+	// ErrorTooManyFiles defines upload has too many files error
+	ErrorTooManyFiles = errors.New("too many files")
+	// ErrorUnsupportedDigest defines digest algorithm is not supported error
+	ErrorUnsupportedDigest = errors.New("unsupported digest algorithm")
+	// ErrorInvalidSignature defines signature is missing or mismatched error
+	ErrorInvalidSignature = errors.New("invalid signature")
+	// ErrorBodyTooLarge defines request body exceeds size limit error
+	ErrorBodyTooLarge = errors.New("request body is too large")
+	// ErrorBodyConsumed defines request body has been consumed by form parsing error
+	ErrorBodyConsumed = errors.New("request body has been consumed")
+	// ErrorUnsupportedEncoding defines request content encoding is not supported error
+	ErrorUnsupportedEncoding = errors.New("unsupported content encoding")
+	// ErrorMalformedBody defines request body can not be decoded error
+	ErrorMalformedBody = errors.New("malformed request body")
+	// ErrorUnknownKey defines signing key id is unknown error
+	ErrorUnknownKey = errors.New("unknown key")
+	// ErrorStaleTimestamp defines request timestamp is missing or out of allowed skew error
+	ErrorStaleTimestamp = errors.New("stale timestamp")
+	// ErrorReplayedNonce defines request nonce is missing or used already error
+	ErrorReplayedNonce = errors.New("replayed nonce")
+	// ErrorInvalidCSRFToken defines csrf token is missing or mismatched error
+	ErrorInvalidCSRFToken = errors.New("invalid csrf token")
+	// ErrorHostNotAllowed defines error of tls handshake for host without certificate
+	ErrorHostNotAllowed = errors.New("host not allowed")
+	// ErrorCertificateRevoked defines error of client certificate listed in revocation lists
+	ErrorCertificateRevoked = errors.New("client certificate is revoked")
+	// ErrorSessionDisabled defines sessions are disabled error
+	ErrorSessionDisabled = errors.New("sessions are disabled")
 )
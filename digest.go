@@ -0,0 +1,167 @@
+package webservice
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// DigestMD5 marks md5 digest, it is kept for compatibility only
+	DigestMD5 = "md5"
+	// DigestSHA256 marks sha-256 digest
+	DigestSHA256 = "sha256"
+	// DigestSHA512 marks sha-512 digest
+	DigestSHA512 = "sha512"
+	// DigestBLAKE2b256 marks blake2b-256 digest
+	DigestBLAKE2b256 = "blake2b-256"
+	// DigestBLAKE2b512 marks blake2b-512 digest
+	DigestBLAKE2b512 = "blake2b-512"
+)
+
+// PartDigest stores digest of a form part
+type PartDigest struct {
+	Name     string
+	Filename string
+	Digest   string
+}
+
+// newDigest builds hash of algorithm, it is a hmac if key is not empty
+func newDigest(algorithm string, key []byte) (hash.Hash, error) {
+	var fn func() hash.Hash
+	switch strings.ToLower(algorithm) {
+	case DigestMD5:
+		fn = md5.New
+	case DigestSHA256:
+		fn = sha256.New
+	case DigestSHA512:
+		fn = sha512.New
+	case DigestBLAKE2b256:
+		fn = func() hash.Hash { h, _ := blake2b.New256(nil); return h }
+	case DigestBLAKE2b512:
+		fn = func() hash.Hash { h, _ := blake2b.New512(nil); return h }
+	default:
+		return nil, ErrorUnsupportedDigest
+	}
+
+	if len(key) > 0 {
+		return hmac.New(fn, key), nil
+	}
+	return fn(), nil
+}
+
+// canonicalParts returns parts sorted by name, parts of the same name keep their order
+func (mfd MultiFormData) canonicalParts() []*FormData {
+	parts := make([]*FormData, len(mfd.parts))
+	copy(parts, mfd.parts)
+	sort.SliceStable(parts, func(i, j int) bool { return parts[i].Name < parts[j].Name })
+	return parts
+}
+
+// writeCanonicalPart writes name, filename and data of part, each one is prefixed
+// with its length as 8 bytes big endian integer so that fields can not be shifted
+func writeCanonicalPart(w io.Writer, fd *FormData) {
+	var size [8]byte
+	for _, field := range [][]byte{[]byte(fd.Name), []byte(fd.Filename), fd.Data} {
+		binary.BigEndian.PutUint64(size[:], uint64(len(field)))
+		w.Write(size[:])
+		w.Write(field)
+	}
+}
+
+// FormDigest computes hex digest of canonical encoding of all form parts,
+// parts are sorted by name and encoded with names and filenames, key enables hmac
+func (mfd MultiFormData) FormDigest(algorithm string, key []byte) (string, error) {
+	h, err := mfd.formDigest(algorithm, key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h), nil
+}
+
+func (mfd MultiFormData) formDigest(algorithm string, key []byte) ([]byte, error) {
+	h, err := newDigest(algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range mfd.canonicalParts() {
+		writeCanonicalPart(h, fd)
+	}
+	return h.Sum(nil), nil
+}
+
+// PartDigests computes hex digest of data of each form part in order they are sent
+func (mfd MultiFormData) PartDigests(algorithm string, key []byte) ([]PartDigest, error) {
+	digests := make([]PartDigest, 0, len(mfd.parts))
+	for _, fd := range mfd.parts {
+		h, err := newDigest(algorithm, key)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(fd.Data)
+		digests = append(digests, PartDigest{
+			Name:     fd.Name,
+			Filename: fd.Filename,
+			Digest:   hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+	return digests, nil
+}
+
+// VerifyFormSignature verifies hmac signature of form sent by client,
+// signature is hex or base64 encoded FormDigest computed with key
+func (mfd MultiFormData) VerifyFormSignature(signature, algorithm string, key []byte) error {
+	if len(key) == 0 {
+		return ErrorInvalidArgument
+	}
+	expected, err := mfd.formDigest(algorithm, key)
+	if err != nil {
+		return err
+	}
+
+	if sig := decodeSignature(signature); sig != nil && hmac.Equal(sig, expected) {
+		return nil
+	}
+	return ErrorInvalidSignature
+}
+
+// decodeSignature decodes hex or base64 encoded signature
+func decodeSignature(signature string) []byte {
+	signature = strings.TrimSpace(signature)
+	if signature == "" {
+		return nil
+	}
+	if data, err := hex.DecodeString(signature); err == nil {
+		return data
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding,
+		base64.RawStdEncoding, base64.RawURLEncoding} {
+		if data, err := enc.DecodeString(signature); err == nil {
+			return data
+		}
+	}
+	return nil
+}
+
+// VerifyRequestFormSignature verifies signature in header of request over its multi form data
+func VerifyRequestFormSignature(r *http.Request, mfd *MultiFormData, header, algorithm string, key []byte) error {
+	if r == nil || mfd == nil {
+		return ErrorInvalidArgument
+	}
+	signature := r.Header.Get(header)
+	if signature == "" {
+		return ErrorInvalidSignature
+	}
+	return mfd.VerifyFormSignature(signature, algorithm, key)
+}
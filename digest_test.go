@@ -0,0 +1,72 @@
+package webservice
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+func buildDigestForm(t *testing.T, fields ...string) *MultiFormData {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for i := 0; i+1 < len(fields); i += 2 {
+		mw.WriteField(fields[i], fields[i+1])
+	}
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/form", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	mfd, err := GetMultiFormData(r, &logger{level: logLevelError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mfd
+}
+
+func TestFormDigest(t *testing.T) {
+	first := buildDigestForm(t, "a", "bc", "d", "e")
+	shifted := buildDigestForm(t, "a", "b", "d", "ce")
+	reordered := buildDigestForm(t, "d", "e", "a", "bc")
+
+	for _, algorithm := range []string{DigestSHA256, DigestSHA512, DigestBLAKE2b256, DigestBLAKE2b512} {
+		digest, err := first.FormDigest(algorithm, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", algorithm, err)
+		}
+		if other, _ := shifted.FormDigest(algorithm, nil); other == digest {
+			t.Fatalf("%v: shifted data has the same digest", algorithm)
+		}
+		if other, _ := reordered.FormDigest(algorithm, nil); other != digest {
+			t.Fatalf("%v: reordered fields have different digest", algorithm)
+		}
+	}
+
+	if _, err := first.FormDigest("crc32", nil); err != ErrorUnsupportedDigest {
+		t.Fatalf("expected unsupported digest error, got %v", err)
+	}
+	if digests, err := first.PartDigests(DigestSHA256, nil); err != nil || len(digests) != 2 || digests[1].Name != "d" {
+		t.Fatalf("unexpected part digests %v with error %v", digests, err)
+	}
+}
+
+func TestVerifyFormSignature(t *testing.T) {
+	mfd := buildDigestForm(t, "name", "value")
+	key := []byte("secret")
+	signature, err := mfd.FormDigest(DigestSHA256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/form", nil)
+	r.Header.Set("X-Signature", signature)
+	if err := VerifyRequestFormSignature(r, mfd, "X-Signature", DigestSHA256, key); err != nil {
+		t.Fatalf("valid signature is rejected: %v", err)
+	}
+	if err := mfd.VerifyFormSignature(signature, DigestSHA256, []byte("other")); err != ErrorInvalidSignature {
+		t.Fatalf("expected invalid signature with wrong key, got %v", err)
+	}
+	if err := VerifyRequestFormSignature(r, mfd, "X-Missing", DigestSHA256, key); err != ErrorInvalidSignature {
+		t.Fatalf("expected invalid signature without header, got %v", err)
+	}
+}
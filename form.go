@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/textproto"
 	"sort"
 	"strings"
 )
@@ -15,14 +16,24 @@ type FormData struct {
 	Name     string
 	Data     []byte
 	Filename string
+	Header   textproto.MIMEHeader
+}
+
+// ContentType returns content type of form part
+func (fd *FormData) ContentType() string {
+	if fd.Header == nil {
+		return ""
+	}
+	return fd.Header.Get("Content-Type")
 }
 
 // MultiFormData defines multi form data object
 type MultiFormData struct {
-	data map[string]*FormData
+	data  map[string][]*FormData
+	parts []*FormData
 }
 
-// GetDataBody get post/put/patch data
+// GetDataBody get post/put/patch data, body can still be read by others after it
 func GetDataBody(r *http.Request, logger Logger) (data []byte, err error) {
 	logger.Debug("entered...")
 	defer func() { logger.Debug("done with error", err) }()
@@ -33,13 +44,21 @@ func GetDataBody(r *http.Request, logger Logger) (data []byte, err error) {
 		return nil, ErrorWrongMethod
 	}
 
-	if r.Form != nil {
-		return nil, ErrorParsedYet
+	body, err := readBodyInMemory(r, BuildBodyConfig(), logger)
+	if err != nil {
+		return nil, err
+	}
+	data, err = body.Bytes()
+	if err != nil {
+		return nil, err
 	}
 
-	data, err = ioutil.ReadAll(r.Body)
-	r.ParseForm()
-	return
+	// keep form values available as before and rewind body for others
+	if r.PostForm == nil {
+		r.ParseForm()
+		rewindBody(r)
+	}
+	return data, nil
 }
 
 // GetMultiFormData reads multi form data of request
@@ -53,12 +72,16 @@ func GetMultiFormData(r *http.Request, logger Logger) (mfd *MultiFormData, err e
 		return nil, err
 	}
 
-	data := make(map[string]*FormData, 16)
+	mfd = &MultiFormData{data: make(map[string][]*FormData, 16)}
 	for {
 		p, err := mr.NextPart()
 		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			logger.Warn("mr.NextPart returned error", err)
+			return nil, err
+		}
 		// we get ipa file
 		content, err := ioutil.ReadAll(p)
 		if err != nil {
@@ -69,27 +92,37 @@ func GetMultiFormData(r *http.Request, logger Logger) (mfd *MultiFormData, err e
 			Name:     p.FormName(),
 			Filename: p.FileName(),
 			Data:     content,
+			Header:   p.Header,
 		}
-		data[p.FormName()] = record
+		mfd.data[p.FormName()] = append(mfd.data[p.FormName()], record)
+		mfd.parts = append(mfd.parts, record)
 		logger.Debug("read form part", "FormName", p.FormName(), "FileName", p.FileName())
 	}
 
-	return &MultiFormData{data: data}, nil
+	return mfd, nil
 }
 
-// FormData get form date from form data set
+// FormData get form date from form data set, the first one is returned for repeated key
 func (mfd MultiFormData) FormData(key string) (data *FormData, err error) {
+	all, err := mfd.FormDataAll(key)
+	if err != nil {
+		return nil, err
+	}
+	return all[0], nil
+}
+
+// FormDataAll get all form data of key in order they are sent
+func (mfd MultiFormData) FormDataAll(key string) ([]*FormData, error) {
 	if mfd.data == nil {
 		return nil, ErrorNotFound
 	}
 
-	data, ok := mfd.data[key]
-	if ok && data != nil {
+	if data, ok := mfd.data[key]; ok && len(data) > 0 {
 		return data, nil
 	}
 
 	for k, v := range mfd.data {
-		if strings.EqualFold(k, key) && v != nil {
+		if strings.EqualFold(k, key) && len(v) > 0 {
 			return v, nil
 		}
 	}
@@ -97,7 +130,45 @@ func (mfd MultiFormData) FormData(key string) (data *FormData, err error) {
 	return nil, ErrorNotFound
 }
 
-// FormDataMD5 computes multi form data md5
+// Values get data of all form parts of key as strings
+func (mfd MultiFormData) Values(key string) []string {
+	all, _ := mfd.FormDataAll(key)
+	values := make([]string, 0, len(all))
+	for _, fd := range all {
+		values = append(values, string(fd.Data))
+	}
+	return values
+}
+
+// Keys get distinct form names in order they first appear
+func (mfd MultiFormData) Keys() []string {
+	keys := make([]string, 0, len(mfd.data))
+	seen := make(map[string]bool, len(mfd.data))
+	for _, p := range mfd.parts {
+		if !seen[p.Name] {
+			seen[p.Name] = true
+			keys = append(keys, p.Name)
+		}
+	}
+	return keys
+}
+
+// Parts get all form parts in order they are sent
+func (mfd MultiFormData) Parts() []*FormData {
+	return mfd.parts
+}
+
+// Each calls fn with form parts in order until fn returns false
+func (mfd MultiFormData) Each(fn func(*FormData) bool) {
+	for _, p := range mfd.parts {
+		if !fn(p) {
+			return
+		}
+	}
+}
+
+// FormDataMD5 computes multi form data md5,
+// it ignores names and filenames and FormDigest should be used for new code
 func (mfd MultiFormData) FormDataMD5() (MD5 string) {
 	// logger.Debug("enter...")
 	// defer func() { logger.Debug("computed md5", MD5) }()
@@ -109,8 +180,9 @@ func (mfd MultiFormData) FormDataMD5() (MD5 string) {
 
 	encoder := md5.New()
 	for _, k := range keys {
-		fd := mfd.data[k]
-		encoder.Write(fd.Data)
+		for _, fd := range mfd.data[k] {
+			encoder.Write(fd.Data)
+		}
 	}
 
 	return hex.EncodeToString(encoder.Sum(nil))
@@ -0,0 +1,48 @@
+package webservice
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestGetMultiFormDataRepeatedFields(t *testing.T) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("tag", "a")
+	fw, _ := mw.CreateFormFile("file", "one.txt")
+	fw.Write([]byte("first"))
+	mw.WriteField("tag", "b")
+	fw, _ = mw.CreateFormFile("file", "two.txt")
+	fw.Write([]byte("second"))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/form", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	mfd, err := GetMultiFormData(r, &logger{level: logLevelError})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if values := mfd.Values("TAG"); !reflect.DeepEqual(values, []string{"a", "b"}) {
+		t.Fatalf("unexpected values %v", values)
+	}
+	files, err := mfd.FormDataAll("file")
+	if err != nil || len(files) != 2 || files[1].Filename != "two.txt" {
+		t.Fatalf("unexpected files %v with error %v", files, err)
+	}
+	if files[0].ContentType() != "application/octet-stream" {
+		t.Fatalf("unexpected content type %v", files[0].ContentType())
+	}
+	if first, _ := mfd.FormData("file"); first.Filename != "one.txt" {
+		t.Fatalf("unexpected first file %v", first.Filename)
+	}
+	if keys := mfd.Keys(); !reflect.DeepEqual(keys, []string{"tag", "file"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if len(mfd.Parts()) != 4 {
+		t.Fatalf("unexpected parts count %v", len(mfd.Parts()))
+	}
+}
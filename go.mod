@@ -1,5 +1,10 @@
 module github.com/lucifinil-long/webservice
 
-go 1.13
+go 1.24
 
-require github.com/fsnotify/fsnotify v1.4.9
+require (
+	github.com/fsnotify/fsnotify v1.4.9
+	golang.org/x/crypto v0.41.0
+)
+
+require golang.org/x/sys v0.35.0 // indirect
@@ -0,0 +1,19 @@
+module github.com/lucifinil-long/webservice/http3
+
+go 1.24
+
+require (
+	github.com/lucifinil-long/webservice v0.0.0
+	github.com/quic-go/quic-go v0.59.1
+)
+
+require (
+	github.com/fsnotify/fsnotify v1.4.9 // indirect
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+)
+
+replace github.com/lucifinil-long/webservice => ../
@@ -0,0 +1,64 @@
+// Package http3 serves http/3 of web service with quic-go, it is kept in its own module
+// so that web service does not depend on quic
+package http3
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	quichttp3 "github.com/quic-go/quic-go/http3"
+)
+
+// Server serves http/3, it is set to HTTP3 of webservice.Config
+type Server struct {
+	lock   sync.Mutex
+	server *quichttp3.Server
+	closed bool
+}
+
+// BuildServer builds a http/3 server
+func BuildServer() *Server {
+	return &Server{}
+}
+
+// Serve serves requests on conn with handler and tls config of server until Shutdown is called
+func (s *Server) Serve(conn net.PacketConn, server *http.Server) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return http.ErrServerClosed
+	}
+	s.server = &quichttp3.Server{
+		Handler:   server.Handler,
+		TLSConfig: server.TLSConfig,
+		// 0-RTT requests can be replayed, so they are not accepted
+		QUICConfig:     &quic.Config{},
+		MaxHeaderBytes: server.MaxHeaderBytes,
+		IdleTimeout:    server.IdleTimeout,
+	}
+	srv := s.server
+	s.lock.Unlock()
+
+	err := srv.Serve(conn)
+	if errors.Is(err, quic.ErrServerClosed) {
+		return http.ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown stops serving and waits for active requests until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.closed = true
+	srv := s.server
+	s.lock.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
+}
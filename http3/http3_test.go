@@ -0,0 +1,98 @@
+package http3
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	quichttp3 "github.com/quic-go/quic-go/http3"
+
+	"github.com/lucifinil-long/webservice"
+)
+
+// writeTestCertificate writes a self-signed certificate of localhost into dir
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "localhost.crt"), filepath.Join(dir, "localhost.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestServeHTTP3(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := webservice.BuildConfig()
+	conf.Logger.SetLevel(3)
+	conf.Pprof = false
+	conf.TLSCert, conf.TLSKey = writeTestCertificate(t, dir)
+	conf.Listeners = []webservice.ListenerConfig{{Addr: "127.0.0.1:0", TLS: true}}
+	conf.HTTP3 = BuildServer()
+	var proto string
+	conf.Handlers = map[string]webservice.RequestHandlerFunc{
+		"/ping": func(w http.ResponseWriter, r *http.Request, _ webservice.WebService) *webservice.ServiceResponse {
+			proto = r.Proto
+			return &webservice.ServiceResponse{Status: webservice.ErrorCodeSuccess, Data: map[int]int{}}
+		},
+	}
+	ws := webservice.StartWebService(conf)
+	defer ws.Close()
+	addr := ws.ServiceAddrs()[0]
+
+	tlsConf := &tls.Config{InsecureSkipVerify: true}
+	rsp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}).Get("https://" + addr + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	altSvc := rsp.Header.Get("Alt-Svc")
+	if altSvc == "" {
+		t.Fatal("http/3 is not advertised")
+	}
+
+	h3 := &quichttp3.Transport{TLSClientConfig: tlsConf}
+	defer h3.Close()
+	rsp, err = (&http.Client{Transport: h3}).Get("https://" + addr + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK || proto != "HTTP/3.0" {
+		t.Fatal("expected http/3 request, got", rsp.StatusCode, proto, "advertised", altSvc)
+	}
+}
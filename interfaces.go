@@ -16,12 +16,20 @@ type WebService interface {
 	Close() error
 	// ServiceAddr returns service address
 	ServiceAddr() string
+	// ServiceAddrs returns bound addresses of all listeners of web service
+	ServiceAddrs() []string
 	// PagesTempLatesDir returns page templates directory of web service
 	PagesTempLatesDir() string
 	// WidgetsTempLatesDir returns widget templates directory of web service
 	WidgetsTempLatesDir() string
 	// TemplatesManager get service related templates manager
 	TemplatesManager() TemplatesManager
+	// UploadsDir returns uploads directory of web service
+	UploadsDir() string
+	// InFlight returns count of requests being handled
+	InFlight() int64
+	// RouteInFlight returns count of requests of route of Handlers being handled
+	RouteInFlight(route string) int64
 }
 
 // TemplatesManager defines templates manager interface definition
@@ -39,13 +47,59 @@ func StartWebService(conf *Config) WebService {
 
 // HTTPProxy defines http proxy interface
 type HTTPProxy interface {
+	// ForwardRequest forwards request to target url and responses client with upstream response
 	ForwardRequest(w http.ResponseWriter, r *http.Request, target *url.URL)
+	// AgentRequest sends request to target url and returns upstream response
 	AgentRequest(r *http.Request, target *url.URL) (*http.Response, error)
+	// AddUpstreamPool adds or replaces a named upstream pool
+	AddUpstreamPool(conf *UpstreamPoolConfig) error
+	// RemoveUpstreamPool removes a named upstream pool
+	RemoveUpstreamPool(name string)
+	// ForwardToPool forwards request to a target selected from named upstream pool
+	ForwardToPool(w http.ResponseWriter, r *http.Request, pool string)
+	// RouteHandler builds handler which can be registered to Config.Handlers,
+	// handler keys end with slash handle all paths under them
+	RouteHandler(route *ProxyRoute) RequestHandlerFunc
+	// Close stops health checks and releases idle upstream connections
+	Close() error
 }
 
-// BuildHTTPProxy builds http proxy object
+// BuildHTTPProxy builds http proxy object with default config,
+// all proxies built by it share one pooled transport
 func BuildHTTPProxy(logger interface{}) HTTPProxy {
-	return &proxy{logger: ConvertLoggerMust(logger)}
+	log := ConvertLoggerMust(logger)
+	conf := BuildProxyConfig()
+	conf.Logger = log
+	return &proxy{ProxyConfig: *conf, logger: log, transport: sharedProxyTransport()}
+}
+
+// BuildHTTPProxyWithConfig builds http proxy object with config
+func BuildHTTPProxyWithConfig(conf *ProxyConfig) (HTTPProxy, error) {
+	return buildProxy(conf)
+}
+
+// HTTPCache defines http cache interface
+type HTTPCache interface {
+	// Handler wraps handler so that its cacheable responses are cached
+	Handler(handler RequestHandlerFunc) RequestHandlerFunc
+	// Purge removes cached responses of host and request uri
+	Purge(host, uri string)
+	// PurgePrefix removes cached responses of host whose request uri has prefix, returns removed count
+	PurgePrefix(host, prefix string) int
+}
+
+// CacheStore defines storage interface of http cache
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, resp *CachedResponse)
+	Delete(key string)
+	// DeletePrefix removes entries whose key has prefix and returns removed count
+	DeletePrefix(prefix string) int
+}
+
+// BuildHTTPCache builds http cache object with config
+func BuildHTTPCache(conf *CacheConfig) HTTPCache {
+	return buildHTTPCache(conf)
 }
 
 // // BuildTemplatesManager builds a templates manager object
@@ -0,0 +1,240 @@
+package webservice
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ListenerConfig defines one listener of web service
+type ListenerConfig struct {
+	// Network is "tcp", "tcp4", "tcp6", "unix" or "systemd", tcp is used if it is empty
+	Network string
+	// Addr is host:port of tcp listener, port 0 binds a free port, socket path of unix listener
+	// or name of systemd listeners
+	Addr string
+	// TLS serves https on listener with certificates of Config
+	TLS bool
+	// SocketMode, SocketOwner and SocketGroup are applied to socket file of unix listener,
+	// owner and group are names or ids, zero values keep defaults
+	SocketMode  os.FileMode
+	SocketOwner string
+	SocketGroup string
+}
+
+// serviceListener is a bound listener of web service
+type serviceListener struct {
+	net.Listener
+	tls bool
+}
+
+// listenerConfigs returns configured listeners, or listener of WebAddr and Port by default
+func (ws *webService) listenerConfigs() []ListenerConfig {
+	if len(ws.Listeners) > 0 {
+		return ws.Listeners
+	}
+	return []ListenerConfig{{
+		Network: "tcp",
+		Addr:    fmt.Sprintf("%v:%v", ws.WebAddr, ws.Port),
+		TLS:     ws.tlsEnabled(),
+	}}
+}
+
+// listen binds all listeners of web service and redirect server,
+// bound listeners are closed if any of them fails
+func (ws *webService) listen() error {
+	for _, conf := range ws.listenerConfigs() {
+		if conf.TLS && ws.server.TLSConfig == nil {
+			ws.closeListeners()
+			return fmt.Errorf("tls listener %v without certificates", conf.Addr)
+		}
+		listeners, err := bindListeners(conf)
+		if err != nil {
+			ws.closeListeners()
+			return err
+		}
+		for _, l := range listeners {
+			ws.Logger.Trace("web service listens on", l.Addr().Network(), l.Addr(), "tls", conf.TLS)
+			ws.listeners = append(ws.listeners, serviceListener{Listener: l, tls: conf.TLS})
+		}
+	}
+	// logs of server address show the real port
+	ws.server.Addr = ws.listeners[0].Addr().String()
+
+	if err := ws.listenHTTP3(); err != nil {
+		ws.closeListeners()
+		return err
+	}
+	return ws.listenRedirect()
+}
+
+// bindListeners binds listeners of conf, systemd may pass several listeners of one name
+func bindListeners(conf ListenerConfig) ([]net.Listener, error) {
+	network := strings.TrimSpace(conf.Network)
+	if network == "" {
+		network = "tcp"
+	}
+	switch network {
+	case ListenerNetworkSystemd:
+		return systemdListeners(strings.TrimSpace(conf.Addr))
+	case ListenerNetworkUnix:
+		l, err := listenUnix(conf)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	default:
+		l, err := net.Listen(network, conf.Addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+}
+
+// listenRedirect binds HTTPSRedirectAddr and http challenge address of acme,
+// both redirect requests to the first tls listener
+func (ws *webService) listenRedirect() error {
+	addrs := make([]string, 0, 2)
+	if addr := strings.TrimSpace(ws.HTTPSRedirectAddr); addr != "" {
+		addrs = append(addrs, addr)
+	}
+	if ws.ACME != nil {
+		if addr := strings.TrimSpace(ws.ACME.HTTPChallengeAddr); addr != "" && addr != strings.TrimSpace(ws.HTTPSRedirectAddr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	port := ""
+	for _, l := range ws.listeners {
+		if _, p, err := net.SplitHostPort(l.Addr().String()); err == nil && l.tls {
+			port = p
+			break
+		}
+	}
+	if port == "" {
+		ws.closeListeners()
+		return fmt.Errorf("https redirect %v without tcp tls listener", addrs)
+	}
+
+	var handler http.Handler = httpsRedirectHandler(port)
+	if ws.acme != nil {
+		handler = ws.acme.httpHandler(handler)
+	}
+	ws.redirectServer = &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: ws.ReadHeaderTimeout,
+		IdleTimeout:       ws.IdleTimeout,
+		MaxHeaderBytes:    ws.MaxHeaderBytes,
+	}
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			ws.closeListeners()
+			return err
+		}
+		ws.Logger.Trace("web service redirects https on", l.Addr())
+		ws.redirectListeners = append(ws.redirectListeners, l)
+	}
+	return nil
+}
+
+// closeListeners closes bound listeners, it is used if web service is closed before they are served,
+// and closes udp connection of http/3 which is not closed by its server
+func (ws *webService) closeListeners() {
+	for _, l := range ws.listeners {
+		l.Close()
+	}
+	for _, l := range ws.redirectListeners {
+		l.Close()
+	}
+	if ws.http3Conn != nil {
+		ws.http3Conn.Close()
+	}
+}
+
+// serve serves all bound listeners until server is closed
+func (ws *webService) serve() {
+	var wg sync.WaitGroup
+	for _, l := range ws.redirectListeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			err := ws.redirectServer.Serve(l)
+			if err != nil && err != http.ErrServerClosed {
+				ws.Logger.Error("serve https redirect", l.Addr(), "with error", err)
+			}
+		}(l)
+	}
+	if ws.http3Server != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ws.serveHTTP3()
+		}()
+	}
+	for _, l := range ws.listeners {
+		wg.Add(1)
+		go func(l serviceListener) {
+			defer wg.Done()
+			var err error
+			if l.tls {
+				ws.Logger.Trace("ServeTLS for", l.Addr())
+				// certificates are got from TLSConfig of server
+				err = ws.server.ServeTLS(l, "", "")
+			} else {
+				ws.Logger.Trace("Serve for", l.Addr())
+				err = ws.server.Serve(l)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				ws.Logger.Error("start web service", l.Addr(), "with error", err)
+				panic(err)
+			}
+		}(l)
+	}
+	wg.Wait()
+}
+
+// ServiceAddrs returns bound addresses of all listeners of web service,
+// addresses of tcp listeners carry the real port even if configured port is 0
+func (ws *webService) ServiceAddrs() []string {
+	addrs := make([]string, 0, len(ws.listeners))
+	for _, l := range ws.listeners {
+		addrs = append(addrs, l.Addr().String())
+	}
+	return addrs
+}
+
+// httpsRedirectHandler redirects requests to https on port, port 443 is omitted
+func httpsRedirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "missing host", http.StatusBadRequest)
+			return
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		status := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			// method and body are kept by permanent redirect
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target.String(), status)
+	})
+}
@@ -0,0 +1,71 @@
+package webservice
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestListenersAndHTTPSRedirect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := BuildConfig()
+	conf.Logger = &logger{level: logLevelError}
+	conf.Pprof = false
+	cert := writeTestCertificate(t, dir, "localhost", "localhost", "localhost")
+	conf.TLSCert, conf.TLSKey = cert.CertFile, cert.KeyFile
+	conf.Listeners = []ListenerConfig{{Addr: "127.0.0.1:0"}, {Addr: "127.0.0.1:0", TLS: true}}
+	conf.HTTPSRedirectAddr = "127.0.0.1:0"
+	conf.Handlers = map[string]RequestHandlerFunc{
+		"/ping": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+		},
+	}
+	ws := StartWebService(conf)
+	defer ws.Close()
+
+	addrs := ws.ServiceAddrs()
+	if len(addrs) != 2 || ws.ServiceAddr() != addrs[0] {
+		t.Fatal("unexpected service addresses", addrs, ws.ServiceAddr())
+	}
+	_, tlsPort, err := net.SplitHostPort(addrs[1])
+	if err != nil || tlsPort == "0" {
+		t.Fatal("real port is not bound", addrs[1], err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(url string) *http.Response {
+		rsp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp
+	}
+
+	if rsp := get("http://" + addrs[0] + "/ping"); rsp.StatusCode != http.StatusOK || rsp.TLS != nil {
+		t.Fatal("unexpected response of plain listener", rsp.StatusCode)
+	}
+	if rsp := get("https://" + addrs[1] + "/ping"); rsp.StatusCode != http.StatusOK || rsp.TLS == nil {
+		t.Fatal("unexpected response of tls listener", rsp.StatusCode)
+	}
+
+	redirect := ws.(*webService).redirectListeners[0].Addr().String()
+	rsp := get("http://" + redirect + "/ping?a=1")
+	expected := "https://127.0.0.1:" + tlsPort + "/ping?a=1"
+	if rsp.StatusCode != http.StatusMovedPermanently || rsp.Header.Get("Location") != expected {
+		t.Fatal("unexpected redirect", rsp.StatusCode, rsp.Header.Get("Location"))
+	}
+}
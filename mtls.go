@@ -0,0 +1,269 @@
+package webservice
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrincipalSchemeClientCertificate marks principal authenticated by verified tls client certificate
+const PrincipalSchemeClientCertificate = "client-certificate"
+
+// ClientAuthConfig stores tls client certificate authentication config
+type ClientAuthConfig struct {
+	// CAFile is pem bundle of certificate authorities which issue client certificates
+	CAFile string
+	// Mode is passed to tls.Config, tls.VerifyClientCertIfGiven lets routes without Routes
+	// serve clients without certificate, tls.RequireAndVerifyClientCert rejects them in handshake.
+	// Certificates are not verified by tls.RequestClientCert and tls.RequireAnyClientCert,
+	// their clients get no principal
+	Mode tls.ClientAuthType
+	// CRLFile is pem or der certificate revocation lists of CAFile, it is reloaded while it changes
+	CRLFile string
+	// Routes lists routes of Handlers which require a verified client certificate
+	Routes []string
+	// Principal maps verified client certificate to principal id, empty id rejects certificate,
+	// ClientCertificatePrincipal is used if it is nil
+	Principal func(cert *x509.Certificate) string
+}
+
+// BuildClientAuthConfig builds a default client certificate authentication config,
+// certificates issued by caFile are required by routes
+func BuildClientAuthConfig(caFile string, routes ...string) *ClientAuthConfig {
+	return &ClientAuthConfig{
+		CAFile: caFile,
+		Mode:   tls.VerifyClientCertIfGiven,
+		Routes: routes,
+	}
+}
+
+// ClientCertificatePrincipal maps certificate to the first uri san, dns san, email san
+// or subject common name of it
+func ClientCertificatePrincipal(cert *x509.Certificate) string {
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// clientAuthenticator verifies client certificates against revocation lists
+// and maps them to principals
+type clientAuthenticator struct {
+	ClientAuthConfig
+	cas    *x509.CertPool
+	caList []*x509.Certificate
+	routes map[string]bool
+	dir    string
+	logger Logger
+
+	lock sync.RWMutex
+	// revoked stores revoked serial numbers keyed by raw subject of issuer
+	revoked map[string]map[string]bool
+}
+
+func buildClientAuthenticator(conf *ClientAuthConfig, log Logger) (*clientAuthenticator, error) {
+	c := &clientAuthenticator{
+		ClientAuthConfig: *conf,
+		cas:              x509.NewCertPool(),
+		routes:           make(map[string]bool, len(conf.Routes)),
+		logger:           log,
+	}
+	for _, route := range conf.Routes {
+		c.routes[route] = true
+	}
+	if c.Principal == nil {
+		c.Principal = ClientCertificatePrincipal
+	}
+
+	data, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		c.cas.AddCert(ca)
+		c.caList = append(c.caList, ca)
+	}
+	if len(c.caList) == 0 {
+		return nil, ErrorInvalidArgument
+	}
+
+	if c.CRLFile != "" {
+		if c.dir, err = filepath.Abs(filepath.Dir(c.CRLFile)); err != nil {
+			return nil, err
+		}
+		if err := c.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// reload loads revocation lists, current lists are kept if loading fails
+func (c *clientAuthenticator) reload() error {
+	data, err := ioutil.ReadFile(c.CRLFile)
+	if err != nil {
+		c.logger.Error("load crl", c.CRLFile, "failed with", err)
+		return err
+	}
+
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+
+	revoked := make(map[string]map[string]bool)
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			c.logger.Error("parse crl", c.CRLFile, "failed with", err)
+			return err
+		}
+		issuer := c.issuerOf(crl)
+		if issuer == nil {
+			c.logger.Error("crl", c.CRLFile, "is not signed by any client ca")
+			return ErrorInvalidSignature
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			c.logger.Warn("crl", c.CRLFile, "of", issuer.Subject, "has expired")
+		}
+		serials := revoked[string(issuer.RawSubject)]
+		if serials == nil {
+			serials = make(map[string]bool)
+			revoked[string(issuer.RawSubject)] = serials
+		}
+		for _, rc := range crl.RevokedCertificateEntries {
+			serials[rc.SerialNumber.String()] = true
+		}
+	}
+
+	c.lock.Lock()
+	c.revoked = revoked
+	c.lock.Unlock()
+	c.logger.Trace("loaded crl", c.CRLFile)
+	return nil
+}
+
+// issuerOf finds ca signing revocation list, entries of list are trusted only if it is found
+func (c *clientAuthenticator) issuerOf(crl *x509.RevocationList) *x509.Certificate {
+	for _, ca := range c.caList {
+		if crl.CheckSignatureFrom(ca) == nil {
+			return ca
+		}
+	}
+	return nil
+}
+
+// watches checks whether path is in directory of revocation lists
+func (c *clientAuthenticator) watches(path string) bool {
+	if c == nil || c.dir == "" {
+		return false
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	return err == nil && dir == c.dir
+}
+
+// revokedIn returns the first revoked certificate of chains, nil if there is none
+func (c *clientAuthenticator) revokedIn(chains [][]*x509.Certificate) *x509.Certificate {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if c.revoked[string(cert.RawIssuer)][cert.SerialNumber.String()] {
+				return cert
+			}
+		}
+	}
+	return nil
+}
+
+// verifyConnection rejects chains containing revoked certificates in handshake,
+// unlike VerifyPeerCertificate it is called for resumed sessions as well
+func (c *clientAuthenticator) verifyConnection(cs tls.ConnectionState) error {
+	if cert := c.revokedIn(cs.VerifiedChains); cert != nil {
+		c.logger.Warn("client certificate", cert.Subject, "serial", cert.SerialNumber, "is revoked")
+		return ErrorCertificateRevoked
+	}
+	return nil
+}
+
+// configure sets client authentication of tls config
+func (c *clientAuthenticator) configure(conf *tls.Config) {
+	conf.ClientCAs = c.cas
+	conf.ClientAuth = c.Mode
+	if c.CRLFile != "" {
+		conf.VerifyConnection = c.verifyConnection
+	}
+}
+
+// principal maps verified client certificate of request to principal, nil if there is none.
+// Certificates are checked against revocation lists again, so that reloaded lists
+// take effect on connections opened before
+func (c *clientAuthenticator) principal(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	if cert := c.revokedIn(r.TLS.VerifiedChains); cert != nil {
+		c.logger.Warn("client certificate", cert.Subject, "serial", cert.SerialNumber, "is revoked")
+		return nil, ErrorCertificateRevoked
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	id := strings.TrimSpace(c.Principal(cert))
+	if id == "" {
+		return nil, nil
+	}
+	return &Principal{ID: id, Scheme: PrincipalSchemeClientCertificate, Certificate: cert}, nil
+}
+
+// checkClientCert sets principal of verified client certificate,
+// requests of routes requiring certificate are rejected without it
+func (ws *webService) checkClientCert(route string, r *http.Request) (*http.Request, *ServiceResponse) {
+	c := ws.clientAuth
+	if c == nil {
+		return r, nil
+	}
+
+	principal, err := c.principal(r)
+	if err != nil {
+		return r, &ServiceResponse{
+			Status:  http.StatusUnauthorized,
+			Message: "client certificate is revoked",
+			Data:    map[int]int{},
+		}
+	}
+	if principal != nil {
+		return withPrincipal(r, principal), nil
+	}
+	if !c.routes[route] {
+		return r, nil
+	}
+	ws.Logger.Warn("webService", "checkClientCert", route, "without verified client certificate")
+	return r, &ServiceResponse{
+		Status:  http.StatusUnauthorized,
+		Message: "client certificate required",
+		Data:    map[int]int{},
+	}
+}
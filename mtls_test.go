@@ -0,0 +1,183 @@
+package webservice
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := createTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test client ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+	caFiles := writeTestPEM(t, dir, "ca", ca, caKey)
+
+	client := func(name string, uri string) (*x509.Certificate, tls.Certificate) {
+		template := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		if uri != "" {
+			u, err := url.Parse(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			template.URIs = []*url.URL{u}
+		}
+		cert, key := createTestCertificate(t, template, ca, caKey)
+		files := writeTestPEM(t, dir, name, cert, key)
+		pair, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, pair
+	}
+	goodCert, good := client("billing", "spiffe://example.com/billing")
+	revokedCert, revoked := client("legacy", "")
+
+	crlFile := filepath.Join(dir, "ca.crl")
+	writeSignedCRL := func(issuer *x509.Certificate, key *ecdsa.PrivateKey, certs ...*x509.Certificate) {
+		list := &x509.RevocationList{
+			Number:     big.NewInt(time.Now().UnixNano()),
+			ThisUpdate: time.Now(),
+			NextUpdate: time.Now().Add(time.Hour),
+		}
+		for _, cert := range certs {
+			list.RevokedCertificateEntries = append(list.RevokedCertificateEntries,
+				x509.RevocationListEntry{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, list, issuer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCRL := func(certs ...*x509.Certificate) {
+		writeSignedCRL(ca, caKey, certs...)
+	}
+	writeCRL()
+
+	var principal *Principal
+	handler := func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+		principal = PrincipalFromRequest(r)
+		return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+	}
+	ws := buildTestService(map[string]RequestHandlerFunc{"/internal": handler, "/public": handler})
+	server := writeTestCertificate(t, dir, "server", "localhost", "localhost")
+	ws.TLSCert, ws.TLSKey = server.CertFile, server.KeyFile
+	ws.ClientAuth = BuildClientAuthConfig(caFiles.CertFile, "/internal")
+	ws.ClientAuth.CRLFile = crlFile
+	ws.initTLS()
+	if !ws.clientAuth.watches(crlFile) {
+		t.Fatal("crl directory is not watched")
+	}
+
+	ts := httptest.NewUnstartedServer(ws.withRequestState(http.HandlerFunc(ws.dispatch)))
+	ts.TLS = ws.server.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(path string, certs ...tls.Certificate) (int, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		}}}
+		principal = nil
+		rsp, err := c.Get(ts.URL + path)
+		if err != nil {
+			return 0, err
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode, nil
+	}
+
+	if code, err := get("/internal", good); err != nil || code != http.StatusOK {
+		t.Fatal("client with certificate got", code, err)
+	}
+	if principal == nil || principal.ID != "spiffe://example.com/billing" ||
+		principal.Scheme != PrincipalSchemeClientCertificate || principal.Certificate == nil {
+		t.Fatalf("unexpected principal %+v", principal)
+	}
+	if code, err := get("/internal"); err != nil || code != http.StatusUnauthorized {
+		t.Fatal("client without certificate got", code, err)
+	}
+	if code, err := get("/public"); err != nil || code != http.StatusOK || principal != nil {
+		t.Fatal("anonymous client of public route got", code, err, principal)
+	}
+
+	// legacy certificate is accepted until it is revoked
+	if code, err := get("/internal", revoked); err != nil || code != http.StatusOK || principal.ID != "legacy" {
+		t.Fatal("client with certificate got", code, err, principal)
+	}
+	kept := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{revoked},
+	}}}
+	resuming := &http.Client{Transport: &http.Transport{DisableKeepAlives: true, TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{revoked},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}}}
+	for _, c := range []*http.Client{kept, resuming} {
+		rsp, err := c.Get(ts.URL + "/internal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+	}
+
+	// revocation list not signed by client ca is not trusted
+	rogue, rogueKey := createTestCertificate(t, &x509.Certificate{
+		Subject:               ca.Subject,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+	writeSignedCRL(rogue, rogueKey, goodCert)
+	if err := ws.clientAuth.reload(); err == nil {
+		t.Fatal("crl of another ca is loaded")
+	}
+
+	writeCRL(revokedCert)
+	if err := ws.clientAuth.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code, err := get("/internal", revoked); err == nil {
+		t.Fatal("client with revoked certificate got", code)
+	}
+	// connections opened and sessions issued before revocation are rejected as well
+	if rsp, err := kept.Get(ts.URL + "/public"); err != nil || rsp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("open connection with revoked certificate got", rsp, err)
+	}
+	if rsp, err := resuming.Get(ts.URL + "/internal"); err == nil {
+		t.Fatal("resumed session with revoked certificate got", rsp.StatusCode, rsp.TLS.DidResume)
+	}
+	if code, err := get("/internal", good); err != nil || code != http.StatusOK {
+		t.Fatal("client with certificate got", code, err)
+	}
+}
@@ -0,0 +1,86 @@
+package webservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// initProtocols enables http/2 cleartext of plain listeners, it is called after initTLS
+func (ws *webService) initProtocols() {
+	if !ws.H2C {
+		return
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(!ws.TLSDisableHTTP2)
+	// only prior knowledge h2c is accepted, as load balancers speak it
+	protocols.SetUnencryptedHTTP2(true)
+	ws.server.Protocols = protocols
+}
+
+// HTTP3Server serves http/3 of web service over udp, it is implemented by
+// github.com/lucifinil-long/webservice/http3 so that web service does not depend on quic
+type HTTP3Server interface {
+	// Serve serves requests on conn until Shutdown is called, Handler, TLSConfig, MaxHeaderBytes
+	// and IdleTimeout of server are used, http.ErrServerClosed is returned after Shutdown
+	Serve(conn net.PacketConn, server *http.Server) error
+	Shutdown(ctx context.Context) error
+}
+
+// listenHTTP3 binds udp address of the first tls listener for http/3,
+// and advertises it to tls clients by Alt-Svc
+func (ws *webService) listenHTTP3() error {
+	if ws.HTTP3 == nil {
+		return nil
+	}
+	var addr string
+	for _, l := range ws.listeners {
+		if _, ok := l.Addr().(*net.TCPAddr); ok && l.tls {
+			addr = l.Addr().String()
+			break
+		}
+	}
+	if addr == "" {
+		return fmt.Errorf("http/3 without tcp tls listener")
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	ws.Logger.Trace("web service serves http/3 on", conn.LocalAddr())
+	ws.http3Conn = conn
+	ws.http3Server = ws.HTTP3
+	ws.http3Handler = ws.server.Handler
+	ws.server.Handler = altSvcHandler(conn.LocalAddr().(*net.UDPAddr).Port, ws.server.Handler)
+	return nil
+}
+
+// serveHTTP3 serves http/3 until server is closed,
+// web service keeps running if it fails since clients fall back to tcp
+func (ws *webService) serveHTTP3() {
+	ws.Logger.Trace("Serve http/3 for", ws.http3Conn.LocalAddr())
+	err := ws.http3Server.Serve(ws.http3Conn, &http.Server{
+		Handler:        ws.http3Handler,
+		TLSConfig:      ws.server.TLSConfig,
+		MaxHeaderBytes: ws.MaxHeaderBytes,
+		IdleTimeout:    ws.IdleTimeout,
+	})
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		ws.Logger.Error("serve http/3", ws.http3Conn.LocalAddr(), "with error", err)
+	}
+}
+
+// altSvcHandler advertises http/3 on port in responses of tls requests
+func altSvcHandler(port int, next http.Handler) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%v"; ma=86400`, port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
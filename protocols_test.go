@@ -0,0 +1,96 @@
+package webservice
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// testHTTP3Server records server passed to Serve and blocks until Shutdown
+type testHTTP3Server struct {
+	served chan *http.Server
+	closed chan struct{}
+}
+
+func (s *testHTTP3Server) Serve(conn net.PacketConn, server *http.Server) error {
+	s.served <- server
+	<-s.closed
+	return http.ErrServerClosed
+}
+
+func (s *testHTTP3Server) Shutdown(ctx context.Context) error {
+	close(s.closed)
+	return nil
+}
+
+func TestH2CAndHTTP3(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protocols")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := BuildConfig()
+	conf.Logger = &logger{level: logLevelError}
+	conf.Pprof = false
+	cert := writeTestCertificate(t, dir, "localhost", "localhost", "localhost")
+	conf.TLSCert, conf.TLSKey = cert.CertFile, cert.KeyFile
+	conf.Listeners = []ListenerConfig{{Addr: "127.0.0.1:0"}, {Addr: "127.0.0.1:0", TLS: true}}
+	conf.H2C = true
+	h3 := &testHTTP3Server{served: make(chan *http.Server, 1), closed: make(chan struct{})}
+	conf.HTTP3 = h3
+	var proto string
+	conf.Handlers = map[string]RequestHandlerFunc{
+		"/ping": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			proto = r.Proto
+			return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+		},
+	}
+	ws := StartWebService(conf)
+	defer ws.Close()
+	addrs := ws.ServiceAddrs()
+
+	get := func(rt http.RoundTripper, url string) *http.Response {
+		rsp, err := (&http.Client{Transport: rt}).Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(url, "responded", rsp.StatusCode)
+		}
+		return rsp
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	get(&http.Transport{Protocols: protocols}, "http://"+addrs[0]+"/ping")
+	if proto != "HTTP/2.0" {
+		t.Fatal("expected h2c request, got", proto)
+	}
+
+	tlsConf := &tls.Config{InsecureSkipVerify: true}
+	rsp := get(&http.Transport{TLSClientConfig: tlsConf}, "https://"+addrs[1]+"/ping")
+	altSvc := rsp.Header.Get("Alt-Svc")
+	if altSvc == "" {
+		t.Fatal("http/3 is not advertised")
+	}
+
+	// requests of http/3 are handled by handler without Alt-Svc
+	served := <-h3.served
+	if served.TLSConfig == nil || served.MaxHeaderBytes != conf.MaxHeaderBytes {
+		t.Fatal("unexpected http/3 server", served)
+	}
+	r := httptest.NewRequest("GET", "https://localhost/ping", nil)
+	r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/3.0", 3, 0
+	w := httptest.NewRecorder()
+	served.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || proto != "HTTP/3.0" || w.Header().Get("Alt-Svc") != "" {
+		t.Fatal("unexpected http/3 response", w.Code, proto, w.Header())
+	}
+}
@@ -1,89 +1,875 @@
 package webservice
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
+// hopHeaders are hop-by-hop headers which must not be forwarded by proxies
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+var (
+	defaultProxyTransport     *http.Transport
+	defaultProxyTransportOnce sync.Once
+)
+
 type proxy struct {
-	logger Logger
+	ProxyConfig
+	logger    Logger
+	transport http.RoundTripper
+	pools     map[string]*upstreamPool
+	poolsLock sync.RWMutex
+
+	breakers     map[string]*circuitBreaker
+	breakersLock sync.Mutex
+}
+
+// sharedProxyTransport returns transport shared by proxies built with default config
+func sharedProxyTransport() *http.Transport {
+	defaultProxyTransportOnce.Do(func() {
+		// default config never fails on building transport
+		defaultProxyTransport, _ = buildProxyTransport(BuildProxyConfig())
+	})
+	return defaultProxyTransport
+}
+
+func buildProxyTransport(conf *ProxyConfig) (*http.Transport, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if len(conf.RootCAs) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range conf.RootCAs {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate found in %v", file)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   conf.DialTimeout,
+			KeepAlive: conf.KeepAlive,
+		}).DialContext,
+		MaxIdleConns:          conf.MaxIdleConns,
+		MaxIdleConnsPerHost:   conf.MaxIdleConnsPerHost,
+		IdleConnTimeout:       conf.IdleConnTimeout,
+		TLSHandshakeTimeout:   conf.TLSHandshakeTimeout,
+		ExpectContinueTimeout: conf.ExpectContinueTimeout,
+		ResponseHeaderTimeout: conf.ResponseHeaderTimeout,
+		TLSClientConfig:       tlsConfig,
+		DisableCompression:    true,
+	}, nil
 }
 
-func (p proxy) jsonResponse(w http.ResponseWriter, r *http.Request, data *ServiceResponse) {
+func buildProxy(conf *ProxyConfig) (*proxy, error) {
+	if conf == nil {
+		conf = BuildProxyConfig()
+	}
+
+	p := &proxy{ProxyConfig: *conf, logger: ConvertLoggerMust(conf.Logger)}
+	p.Logger = p.logger
+	tr, err := buildProxyTransport(conf)
+	if err != nil {
+		p.logger.Error("build proxy transport failed with", err)
+		return nil, err
+	}
+	p.transport = tr
+	return p, nil
+}
+
+func (p *proxy) jsonResponse(w http.ResponseWriter, r *http.Request, data *ServiceResponse) {
 	jsonResponse(w, r, data, "http proxy", p.logger)
 }
 
-func (p proxy) ForwardRequest(w http.ResponseWriter, r *http.Request, target *url.URL) {
+// ForwardRequest forwards request to target and copies upstream response to w,
+// target is the full url which will be requested from upstream
+func (p *proxy) ForwardRequest(w http.ResponseWriter, r *http.Request, target *url.URL) {
 	p.logger.Trace("entered...")
 	defer p.logger.Trace("done.")
 
-	resp, err := p.agentRequest(r, target)
+	if target == nil || r == nil {
+		p.logger.Warn("invalid arument", "target", target, "request", r)
+		p.errorResponse(w, r, ErrorInvalidArgument)
+		return
+	}
+
+	cb := p.breakerFor(target)
+	p.forward(w, r, p.forwardOptions(nil), func() (*url.URL, func(attemptResult), error) {
+		if !cb.allow(time.Now()) {
+			return nil, nil, ErrorCircuitOpen
+		}
+		return target, cb.finish, nil
+	})
+}
+
+// AddUpstreamPool adds or replaces upstream pool and starts its health check
+func (p *proxy) AddUpstreamPool(conf *UpstreamPoolConfig) error {
+	pool, err := buildUpstreamPool(conf, &p.ProxyConfig, p.logger)
 	if err != nil {
-		p.logger.Trace("agent request failed with", err)
-		p.jsonResponse(w, r, &ServiceResponse{
-			Status:  http.StatusInternalServerError,
-			Message: err.Error(),
-			Data:    map[int]int{},
-		})
+		p.logger.Error("build upstream pool failed with", err)
+		return err
+	}
+
+	p.poolsLock.Lock()
+	if p.pools == nil {
+		p.pools = make(map[string]*upstreamPool)
+	}
+	old := p.pools[pool.Name]
+	p.pools[pool.Name] = pool
+	p.poolsLock.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	pool.startHealthCheck(p.transport)
+	p.logger.Trace("upstream pool", pool.Name, "is added with", len(pool.upstreams), "targets")
+	return nil
+}
+
+// RemoveUpstreamPool removes upstream pool and stops its health check
+func (p *proxy) RemoveUpstreamPool(name string) {
+	p.poolsLock.Lock()
+	pool := p.pools[name]
+	delete(p.pools, name)
+	p.poolsLock.Unlock()
+
+	if pool != nil {
+		pool.close()
+	}
+}
+
+func (p *proxy) upstreamPool(name string) *upstreamPool {
+	p.poolsLock.RLock()
+	defer p.poolsLock.RUnlock()
+	return p.pools[name]
+}
+
+// ForwardToPool forwards request to a target of upstream pool with request path and query
+func (p *proxy) ForwardToPool(w http.ResponseWriter, r *http.Request, pool string) {
+	p.forwardRoute(w, r, &ProxyRoute{Pool: pool}, nil)
+}
+
+// RouteHandler builds handler which forwards requests as route defines
+func (p *proxy) RouteHandler(route *ProxyRoute) RequestHandlerFunc {
+	rw, err := compileRewriteRules(route.Rewrite, route.StripPrefix)
+	if err != nil {
+		p.logger.Error("compile rewrite rules of route to", route.Pool, "failed with", err)
+		return func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			p.statusResponse(w, r, http.StatusInternalServerError)
+			return nil
+		}
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+		p.forwardRoute(w, r, route, rw)
+		return nil
+	}
+	if route.Cache != nil {
+		return route.Cache.Handler(handler)
+	}
+	return handler
+}
+
+func (p *proxy) forwardRoute(w http.ResponseWriter, r *http.Request, route *ProxyRoute, rw *rewriter) {
+	p.logger.Trace("entered...")
+	defer p.logger.Trace("done.")
+
+	pool := p.upstreamPool(route.Pool)
+	if pool == nil {
+		p.logger.Warn("upstream pool", route.Pool, "is not found")
+		p.errorResponse(w, r, ErrorNoUpstream)
+		return
+	}
+
+	path := r.URL.Path
+	if route.StripPrefix != "" && strings.HasPrefix(path, route.StripPrefix) {
+		path = path[len(route.StripPrefix):]
+	}
+	path = rw.rewritePath(path)
+
+	opts := p.forwardOptions(route)
+	opts.rewriter = rw
+	p.forward(w, r, opts, func() (*url.URL, func(attemptResult), error) {
+		u, err := pool.pick(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return upstreamURL(u.url, r, path), func(result attemptResult) { pool.finish(u, result) }, nil
+	})
+}
+
+// attemptResult is result of forwarding attempt reported to target
+type attemptResult int
+
+const (
+	attemptSucceeded attemptResult = iota
+	attemptFailed
+	// attemptAborted marks attempt which never reached target, it counts neither as success nor failure
+	attemptAborted
+)
+
+// resultOf converts failure of attempt to its result
+func resultOf(failed bool) attemptResult {
+	if failed {
+		return attemptFailed
+	}
+	return attemptSucceeded
+}
+
+// upstreamPicker selects target for an attempt, done must be called with result of the attempt
+type upstreamPicker func() (target *url.URL, done func(result attemptResult), err error)
+
+// rewriteError is error of rewriting request locally, it is not a failure of upstream
+type rewriteError struct {
+	err error
+}
+
+func (e *rewriteError) Error() string {
+	return "rewrite request failed with " + e.err.Error()
+}
+
+// attemptAbortedBy checks whether attempt failed with err before target could answer it, because
+// rewriting request failed or request was canceled by client or handler timeout
+func attemptAbortedBy(r *http.Request, err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(*rewriteError); ok {
+		return true
+	}
+	return r.Context().Err() != nil
+}
+
+// forwardOptions stores resolved timeout and retry settings of forwarding
+type forwardOptions struct {
+	timeout     time.Duration
+	retries     int
+	backoff     time.Duration
+	maxBodySize int64
+	rewriter    *rewriter
+}
+
+func (p *proxy) forwardOptions(route *ProxyRoute) *forwardOptions {
+	opts := &forwardOptions{
+		timeout:     p.Timeout,
+		retries:     p.Retries,
+		backoff:     p.RetryBackoff,
+		maxBodySize: p.MaxRetryBodySize,
+	}
+	if route != nil {
+		if route.Timeout > 0 {
+			opts.timeout = route.Timeout
+		}
+		if route.Retries != 0 {
+			opts.retries = route.Retries
+		}
+	}
+	if opts.retries < 0 {
+		opts.retries = 0
+	}
+	return opts
+}
+
+// forward sends request to targets selected by pick, idempotent requests are retried on failures
+func (p *proxy) forward(w http.ResponseWriter, r *http.Request, opts *forwardOptions, pick upstreamPicker) {
+	body, err := readReplayableBody(r, opts.maxBodySize)
+	if err != nil {
+		p.logger.Warn("read request body from", r.RemoteAddr, "failed with", err)
+		p.statusResponse(w, r, http.StatusBadRequest)
+		return
+	}
+
+	attempts := 1
+	if body.replayable() && isIdempotentRequest(r) && upgradeType(r.Header) == "" {
+		attempts += opts.retries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 && !sleepWithContext(r.Context(), retryBackoff(opts.backoff, attempt)) {
+			break
+		}
+
+		target, done, err := pick()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		resp, err := p.roundTrip(r, target, body, opts)
+		if attemptAbortedBy(r, err) {
+			// the same rewrite fails on any target and canceled request is not waited for,
+			// so it is neither retried nor blamed on target
+			done(attemptAborted)
+			lastErr = err
+			break
+		}
+		failed := isUpstreamFailure(resp, err)
+		if failed && attempt+1 < attempts {
+			done(attemptFailed)
+			if err == nil {
+				resp.Body.Close()
+				err = fmt.Errorf("upstream responded status %v", resp.StatusCode)
+			}
+			p.logger.Trace("attempt", attempt+1, "to", target, "failed with", err, "and will be retried")
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			done(attemptFailed)
+			lastErr = err
+			break
+		}
+
+		if err = opts.rewriter.rewriteResponse(resp, r); err != nil {
+			resp.Body.Close()
+			done(attemptSucceeded)
+			lastErr = err
+			break
+		}
+		p.writeResponse(w, r, resp)
+		done(resultOf(failed))
+		return
+	}
+
+	p.errorResponse(w, r, lastErr)
+}
+
+// roundTrip sends request to target, timeout of opts limits waiting for response headers
+func (p *proxy) roundTrip(r *http.Request, target *url.URL, body *replayableBody, opts *forwardOptions) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	out := p.outgoingRequest(r.WithContext(ctx), target)
+	if body != nil {
+		out.Body = body.reader()
+	}
+	if err := opts.rewriter.rewriteRequest(out); err != nil {
+		cancel()
+		return nil, &rewriteError{err: err}
+	}
+
+	var timer *time.Timer
+	if opts.timeout > 0 {
+		timer = time.AfterFunc(opts.timeout, cancel)
+	}
+	resp, err := p.transport.RoundTrip(out)
+	timedOut := timer != nil && !timer.Stop()
+	if err != nil || timedOut {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		if timedOut {
+			return nil, ErrorUpstreamTimeout
+		}
+		return nil, err
+	}
+
+	// body of switching protocols response is the upgraded connection
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &cancelOnCloseConn{ReadWriteCloser: conn, cancel: cancel}
+	} else {
+		resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	}
+	return resp, nil
+}
+
+func (p *proxy) errorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	status := proxyErrorStatus(err)
+	p.logger.Warn("forward request", r.URL.Path, "from", r.RemoteAddr, "failed with", err,
+		"and responses status", status)
+	p.statusResponse(w, r, status)
+}
+
+func (p *proxy) statusResponse(w http.ResponseWriter, r *http.Request, status int) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(status)
+	p.jsonResponse(w, r, &ServiceResponse{
+		Status:     status,
+		Message:    strings.ToLower(http.StatusText(status)),
+		Data:       map[int]int{},
+		StatusCode: status,
+	})
+}
+
+func (p *proxy) breakerFor(target *url.URL) *circuitBreaker {
+	key := target.Scheme + "://" + target.Host
+	p.breakersLock.Lock()
+	defer p.breakersLock.Unlock()
+
+	if p.breakers == nil {
+		p.breakers = make(map[string]*circuitBreaker)
+	}
+	cb, ok := p.breakers[key]
+	if !ok {
+		cb = buildCircuitBreaker(&p.ProxyConfig)
+		p.breakers[key] = cb
+	}
+	return cb
+}
+
+// Close stops health checks of upstream pools and closes idle upstream connections
+func (p *proxy) Close() error {
+	p.poolsLock.Lock()
+	pools := p.pools
+	p.pools = nil
+	p.poolsLock.Unlock()
+
+	for _, pool := range pools {
+		pool.close()
+	}
+	if tr, ok := p.transport.(*http.Transport); ok && tr != defaultProxyTransport {
+		tr.CloseIdleConnections()
+	}
+	return nil
+}
+
+// writeResponse copies upstream response to client and closes response body
+func (p *proxy) writeResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		p.handleUpgrade(w, r, resp)
 		return
 	}
 	defer resp.Body.Close()
 
-	for k, v := range resp.Header {
+	removeHopHeaders(resp.Header)
+	copyHeader(w.Header(), resp.Header)
+
+	// announce trailers which will be sent after body
+	if len(resp.Trailer) > 0 {
+		trailers := make([]string, 0, len(resp.Trailer))
+		for k := range resp.Trailer {
+			trailers = append(trailers, k)
+		}
+		w.Header().Add("Trailer", strings.Join(trailers, ", "))
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	written, err := p.copyResponseBody(w, resp)
+	if err != nil {
+		p.logger.Warn("copy upstream response to", r.RemoteAddr, "failed with", err)
+	}
+	p.logger.Trace("has written", written, "bytes to", r.RemoteAddr)
+
+	for k, v := range resp.Trailer {
 		for _, vv := range v {
 			w.Header().Add(k, vv)
 		}
 	}
+}
 
-	written, err := io.Copy(w, resp.Body)
-	p.logger.Trace("has written", written, "bytes to", r.RemoteAddr)
+func (p *proxy) copyResponseBody(w http.ResponseWriter, resp *http.Response) (int64, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return io.Copy(w, resp.Body)
+	}
+
+	interval := p.flushInterval(resp)
+	if interval == 0 {
+		written, err := io.Copy(w, resp.Body)
+		// flushing a writer which buffers whole response, such as cache, would stop its buffering
+		if b, ok := w.(interface{ buffering() bool }); !ok || !b.buffering() {
+			flusher.Flush()
+		}
+		return written, err
+	}
+
+	fw := &latencyFlushWriter{dst: w, flusher: flusher, latency: interval}
+	defer fw.stop()
+	written, err := io.Copy(fw, resp.Body)
+	flusher.Flush()
+	return written, err
+}
+
+// flushInterval returns flush interval for response, streaming responses are flushed immediately
+func (p *proxy) flushInterval(resp *http.Response) time.Duration {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" || resp.ContentLength == -1 {
+		return -1
+	}
+	return p.FlushInterval
+}
+
+func (p *proxy) handleUpgrade(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	reqUpgrade := upgradeType(r.Header)
+	respUpgrade := upgradeType(resp.Header)
+	if !strings.EqualFold(reqUpgrade, respUpgrade) {
+		resp.Body.Close()
+		p.logger.Warn("upstream switched to protocol", respUpgrade, "while", reqUpgrade, "is requested")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	backConn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		p.logger.Warn("upstream connection of switching protocols response is not writable")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer backConn.Close()
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		p.logger.Warn("response writer does not support hijacking")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		p.logger.Warn("hijack connection of", r.RemoteAddr, "failed with", err)
+		return
+	}
+	defer conn.Close()
+
+	removeHopHeaders(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", respUpgrade)
+	resp.Body = nil
+	if err = resp.Write(brw); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		p.logger.Warn("write switching protocols response to", r.RemoteAddr, "failed with", err)
+		return
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backConn, brw)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, backConn)
+		errc <- err
+	}()
+	err = <-errc
+	p.logger.Trace("upgraded connection of", r.RemoteAddr, "is finished with", err)
 }
 
-func (p proxy) agentRequest(r *http.Request, target *url.URL) (*http.Response, error) {
+// outgoingRequest builds request sent to target from incoming request
+func (p *proxy) outgoingRequest(r *http.Request, target *url.URL) *http.Request {
+	out := r.Clone(r.Context())
+	u := *target
+	out.URL = &u
+	out.RequestURI = ""
+	out.Close = false
+	if p.PreserveHost {
+		out.Host = r.Host
+	} else {
+		out.Host = ""
+	}
+	if r.ContentLength == 0 {
+		out.Body = nil
+	}
+
+	reqUpgrade := upgradeType(r.Header)
+	removeHopHeaders(out.Header)
+	// keep trailers support announcement, it is required by grpc
+	if httpHeaderHasToken(r.Header, "Te", "trailers") {
+		out.Header.Set("Te", "trailers")
+	}
+	if reqUpgrade != "" {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", reqUpgrade)
+	}
+	if _, ok := out.Header["User-Agent"]; !ok {
+		// avoid default user agent of go http client
+		out.Header.Set("User-Agent", "")
+	}
+
+	setForwardedHeaders(out, r)
+	return out
+}
+
+func (p *proxy) agentRequest(r *http.Request, target *url.URL) (*http.Response, error) {
 	if target == nil || r == nil {
 		p.logger.Warn("invalid arument", "target", target, "request", r)
 		return nil, ErrorInvalidArgument
 	}
 
-	tr := &http.Transport{
-		Proxy: func(_ *http.Request) (*url.URL, error) { return target, nil },
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Minute,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       30 * time.Minute,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		MaxIdleConnsPerHost:   100,
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-		DisableCompression:    true,
+	cb := p.breakerFor(target)
+	if !cb.allow(time.Now()) {
+		return nil, ErrorCircuitOpen
+	}
+	resp, err := p.roundTrip(r, target, nil, p.forwardOptions(nil))
+	if attemptAbortedBy(r, err) {
+		cb.finish(attemptAborted)
+	} else {
+		cb.finish(resultOf(isUpstreamFailure(resp, err)))
+	}
+	return resp, err
+}
+
+func (p *proxy) AgentRequest(r *http.Request, target *url.URL) (*http.Response, error) {
+	p.logger.Trace("entered...")
+	defer p.logger.Trace("done.")
+
+	return p.agentRequest(r, target)
+}
+
+// setForwardedHeaders sets X-Forwarded-* and Forwarded headers of out from incoming request r
+func setForwardedHeaders(out, r *http.Request) {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
 	}
 
-	c := &http.Client{Transport: tr}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior, ok := r.Header["X-Forwarded-For"]; ok && len(prior) > 0 {
+			out.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+ip)
+		} else {
+			out.Header.Set("X-Forwarded-For", ip)
+		}
 
-	req, err := http.NewRequest(r.Method, target.String(), r.Body)
-	if err != nil {
-		p.logger.Trace("new request failed with", err)
-		return nil, err
+		forNode := ip
+		if strings.Contains(ip, ":") {
+			forNode = "[" + ip + "]"
+		}
+		forwarded := fmt.Sprintf("for=%q;host=%q;proto=%v", forNode, r.Host, proto)
+		if prior, ok := r.Header["Forwarded"]; ok && len(prior) > 0 {
+			forwarded = strings.Join(prior, ", ") + ", " + forwarded
+		}
+		out.Header.Set("Forwarded", forwarded)
+	}
+
+	// host and proto supplied by client can not be trusted, they describe this hop only
+	out.Header.Set("X-Forwarded-Host", r.Host)
+	out.Header.Set("X-Forwarded-Proto", proto)
+}
+
+// removeHopHeaders removes hop-by-hop headers and headers listed in Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				h.Del(f)
+			}
+		}
 	}
-	for k, v := range r.Header {
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+func upgradeType(h http.Header) string {
+	if !httpHeaderHasToken(h, "Connection", "upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// httpHeaderHasToken checks whether comma separated header values contains token case-insensitively
+func httpHeaderHasToken(h http.Header, key, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
 		for _, vv := range v {
-			req.Header.Add(k, vv)
+			dst.Add(k, vv)
 		}
 	}
+}
 
-	return c.Do(req)
+// latencyFlushWriter flushes written data to client at most latency later
+type latencyFlushWriter struct {
+	dst     io.Writer
+	flusher http.Flusher
+	latency time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
 }
 
-func (p proxy) AgentRequest(r *http.Request, target *url.URL) (*http.Response, error) {
-	p.logger.Trace("entered...")
-	defer p.logger.Trace("done.")
+func (fw *latencyFlushWriter) Write(data []byte) (n int, err error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
 
-	return p.agentRequest(r, target)
+	n, err = fw.dst.Write(data)
+	if fw.latency < 0 {
+		fw.flusher.Flush()
+		return
+	}
+	if fw.pending {
+		return
+	}
+	if fw.timer == nil {
+		fw.timer = time.AfterFunc(fw.latency, fw.delayedFlush)
+	} else {
+		fw.timer.Reset(fw.latency)
+	}
+	fw.pending = true
+	return
+}
+
+func (fw *latencyFlushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if !fw.pending {
+		return
+	}
+	fw.flusher.Flush()
+	fw.pending = false
+}
+
+func (fw *latencyFlushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.pending = false
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
+
+// proxyErrorStatus maps forwarding error to response status
+func proxyErrorStatus(err error) int {
+	if _, ok := err.(*rewriteError); ok {
+		return http.StatusInternalServerError
+	}
+	switch err {
+	case ErrorNoUpstream, ErrorCircuitOpen:
+		return http.StatusServiceUnavailable
+	case ErrorUpstreamTimeout, context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case ErrorInvalidArgument:
+		return http.StatusInternalServerError
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// isIdempotentRequest checks whether request can be retried safely
+func isIdempotentRequest(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != ""
+}
+
+// retryBackoff returns exponential backoff with jitter before attempt
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	d := base << uint(attempt-1)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// replayableBody buffers request body so that it can be sent more than once,
+// body larger than buffer limit is streamed and can be sent only once
+type replayableBody struct {
+	data []byte
+	rest io.Reader
+}
+
+func readReplayableBody(r *http.Request, limit int64) (*replayableBody, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return nil, nil
+	}
+	if limit <= 0 || r.ContentLength > limit {
+		return &replayableBody{rest: r.Body}, nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return &replayableBody{data: data, rest: r.Body}, nil
+	}
+	return &replayableBody{data: data}, nil
+}
+
+func (b *replayableBody) replayable() bool {
+	return b == nil || b.rest == nil
+}
+
+func (b *replayableBody) reader() io.ReadCloser {
+	if b.rest == nil {
+		return ioutil.NopCloser(bytes.NewReader(b.data))
+	}
+	return ioutil.NopCloser(io.MultiReader(bytes.NewReader(b.data), b.rest))
+}
+
+// cancelOnCloseBody cancels upstream request context when response body is closed
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// cancelOnCloseConn cancels upstream request context when upgraded connection is closed
+type cancelOnCloseConn struct {
+	io.ReadWriteCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnCloseConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.cancel()
+	return err
 }
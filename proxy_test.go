@@ -0,0 +1,203 @@
+package webservice
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForwardRequestHeadersAndStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Hop") != "" || r.Header.Get("Keep-Alive") != "" {
+			t.Errorf("hop-by-hop headers are forwarded: %v", r.Header)
+		}
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "10.0.0.1, 192.0.2.1" {
+			t.Errorf("unexpected X-Forwarded-For %q", xff)
+		}
+		if r.Header.Get("X-Forwarded-Proto") != "http" || r.Header.Get("X-Forwarded-Host") != "example.com" ||
+			r.Header.Get("Forwarded") == "" {
+			t.Errorf("forwarded headers are not set: %v", r.Header)
+		}
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "1")
+		w.Header().Set("X-Upstream", "1")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("teapot"))
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL + "/tea")
+	p := BuildHTTPProxy(nil)
+
+	r := httptest.NewRequest("GET", "http://example.com/tea", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("Connection", "X-Hop, Keep-Alive")
+	r.Header.Set("X-Hop", "1")
+	r.Header.Set("Keep-Alive", "timeout=5")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	r.Header.Set("X-Forwarded-Host", "evil.example.com")
+	r.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	p.ForwardRequest(w, r, target)
+
+	if w.Code != http.StatusTeapot {
+		t.Fatalf("expected status %v, got %v", http.StatusTeapot, w.Code)
+	}
+	if w.Body.String() != "teapot" {
+		t.Fatalf("unexpected body %q", w.Body.String())
+	}
+	if w.Header().Get("X-Upstream") != "1" || w.Header().Get("X-Upstream-Hop") != "" {
+		t.Fatalf("unexpected response headers %v", w.Header())
+	}
+}
+
+func TestForwardRequestUpgrade(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) != "echo" {
+			t.Errorf("upgrade is not forwarded: %v", r.Header)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		line, _ := brw.ReadString('\n')
+		brw.WriteString(line)
+		brw.Flush()
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	p := BuildHTTPProxy(nil)
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ForwardRequest(w, r, target)
+	}))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: front\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("expected switching protocols, got %v %s", resp.StatusCode, body)
+	}
+	conn.Write([]byte("hello\n"))
+	line, err := br.ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Fatalf("unexpected echo %q with error %v", line, err)
+	}
+}
+
+func TestForwardRequestRetryTimeoutAndBreaker(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		switch r.URL.Path {
+		case "/flaky":
+			if n == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer upstream.Close()
+
+	conf := BuildProxyConfig()
+	conf.Logger = &logger{level: logLevelError}
+	conf.Timeout = 50 * time.Millisecond
+	conf.RetryBackoff = time.Millisecond
+	conf.Retries = 1
+	conf.BreakerFailures = 2
+	conf.BreakerOpenTimeout = time.Hour
+	p, err := BuildHTTPProxyWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forward := func(path string) *httptest.ResponseRecorder {
+		target, _ := url.Parse(upstream.URL + path)
+		w := httptest.NewRecorder()
+		p.ForwardRequest(w, httptest.NewRequest("GET", path, nil), target)
+		return w
+	}
+
+	if w := forward("/flaky"); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("request is not retried, got %v %q", w.Code, w.Body.String())
+	}
+	if w := forward("/slow"); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected gateway timeout, got %v", w.Code)
+	}
+	if w := forward("/broken"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected circuit breaker to open, got %v", w.Code)
+	}
+}
+
+func TestForwardRequestCanceledByClient(t *testing.T) {
+	var calls int32
+	received := make(chan struct{}, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/slow" {
+			received <- struct{}{}
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	conf := BuildProxyConfig()
+	conf.Logger = &logger{level: logLevelError}
+	conf.Retries = 1
+	conf.BreakerFailures = 1
+	conf.BreakerOpenTimeout = time.Hour
+	p, err := BuildHTTPProxyWithConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	target, _ := url.Parse(upstream.URL + "/slow")
+	p.ForwardRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil).WithContext(ctx), target)
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("canceled request is retried, got %v calls", n)
+	}
+
+	// canceled request is not counted as failure of upstream
+	target, _ = url.Parse(upstream.URL + "/ok")
+	w := httptest.NewRecorder()
+	p.ForwardRequest(w, httptest.NewRequest("GET", "/ok", nil), target)
+	if w.Code != http.StatusOK {
+		t.Fatalf("circuit breaker is opened by canceled request, got %v", w.Code)
+	}
+}
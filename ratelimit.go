@@ -0,0 +1,260 @@
+package webservice
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RateLimitTokenBucket refills tokens continuously and allows bursts up to bucket capacity
+	RateLimitTokenBucket = "token-bucket"
+	// RateLimitSlidingWindow counts requests in a window sliding over two fixed windows
+	RateLimitSlidingWindow = "sliding-window"
+)
+
+const (
+	// RateLimitKeyIP limits each client ip
+	RateLimitKeyIP = "ip"
+	// RateLimitKeyAPIKey limits each api key sent in header, client ip is used without api key
+	RateLimitKeyAPIKey = "api-key"
+	// RateLimitKeyPrincipal limits each authenticated principal, client ip is used for anonymous request
+	RateLimitKeyPrincipal = "principal"
+)
+
+// RateLimit stores a rate limit rule
+type RateLimit struct {
+	Algorithm string
+	// Limit is count of requests allowed in Window
+	Limit  int
+	Window time.Duration
+	// Burst is capacity of token bucket, zero means Limit
+	Burst int
+	// Key selects what is limited, zero value means client ip
+	Key string
+	// Header carries api key for RateLimitKeyAPIKey
+	Header string
+}
+
+// BuildRateLimit builds a token bucket rate limit of limit requests in window per client ip
+func BuildRateLimit(limit int, window time.Duration) *RateLimit {
+	return &RateLimit{
+		Algorithm: RateLimitTokenBucket,
+		Limit:     limit,
+		Window:    window,
+		Key:       RateLimitKeyIP,
+		Header:    "X-Api-Key",
+	}
+}
+
+// RateLimitResult stores result of taking a request from rate limit
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the duration until limit is fully available again
+	Reset time.Duration
+	// RetryAfter is the duration until next request is allowed if it is not allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitStore defines storage interface of rate limit states,
+// it can be implemented on shared storage to limit across instances
+type RateLimitStore interface {
+	// Take takes a request of key from limit
+	Take(key string, limit *RateLimit) (*RateLimitResult, error)
+}
+
+// rateLimitKey builds store key of request for limit in scope
+func rateLimitKey(scope string, limit *RateLimit, r *http.Request) string {
+	key := "ip:" + clientIP(r.RemoteAddr)
+	switch limit.Key {
+	case RateLimitKeyAPIKey:
+		if limit.Header != "" {
+			if apiKey := strings.TrimSpace(r.Header.Get(limit.Header)); apiKey != "" {
+				key = "key:" + apiKey
+			}
+		}
+	case RateLimitKeyPrincipal:
+		if p := PrincipalFromRequest(r); p != nil {
+			key = "principal:" + p.Scheme + ":" + p.ID
+		}
+	}
+	return scope + "\n" + key
+}
+
+// checkRateLimit takes request from global and route rate limits keyed by principal or not,
+// limits not keyed by principal are checked before any work is done for request,
+// the others are checked after principal is authenticated.
+// Headers of the most restrictive limit are set to response
+func (ws *webService) checkRateLimit(route string, w http.ResponseWriter, r *http.Request, byPrincipal bool) *ServiceResponse {
+	if ws.RateLimitStore == nil {
+		return nil
+	}
+
+	var result *RateLimitResult
+	take := func(scope string, limit *RateLimit) {
+		if limit == nil || limit.Limit <= 0 || limit.Window <= 0 ||
+			(limit.Key == RateLimitKeyPrincipal) != byPrincipal {
+			return
+		}
+		res, err := ws.RateLimitStore.Take(rateLimitKey(scope, limit, r), limit)
+		if err != nil {
+			// fail open so that broken shared storage does not take service down
+			ws.Logger.Warn("webService", "checkRateLimit", scope, "failed with", err)
+			return
+		}
+		if result == nil || (result.Allowed && !res.Allowed) ||
+			(result.Allowed == res.Allowed && res.Remaining < result.Remaining) {
+			result = res
+		}
+	}
+	take("", ws.RateLimit)
+	if limit, ok := ws.RouteRateLimits[route]; ok {
+		take(route, limit)
+	}
+	if result == nil {
+		return nil
+	}
+
+	header := w.Header()
+	if remaining, err := strconv.Atoi(header.Get("RateLimit-Remaining")); err == nil &&
+		result.Allowed && remaining <= result.Remaining {
+		// headers of more restrictive limit are set by the former check
+		return nil
+	}
+	header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if result.Allowed {
+		return nil
+	}
+
+	header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	return &ServiceResponse{
+		Status:  http.StatusTooManyRequests,
+		Message: "too many requests",
+		Data:    map[int]int{},
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimitEntry stores state of a key for both algorithms
+type rateLimitEntry struct {
+	tokens      float64
+	updated     time.Time
+	windowStart time.Time
+	current     int
+	previous    int
+	expires     time.Time
+}
+
+// memoryRateLimitStore stores rate limit states in memory, idle states are swept while taking
+type memoryRateLimitStore struct {
+	lock      sync.Mutex
+	entries   map[string]*rateLimitEntry
+	lastSweep time.Time
+}
+
+// BuildMemoryRateLimitStore builds a rate limit store keeping states in memory
+func BuildMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{entries: make(map[string]*rateLimitEntry, 1024), lastSweep: time.Now()}
+}
+
+func (s *memoryRateLimitStore) Take(key string, limit *RateLimit) (*RateLimitResult, error) {
+	if limit == nil || limit.Limit <= 0 || limit.Window <= 0 {
+		return nil, ErrorInvalidArgument
+	}
+
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, e := range s.entries {
+			if now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	e, ok := s.entries[key]
+	if !ok {
+		e = &rateLimitEntry{}
+		s.entries[key] = e
+	}
+	e.expires = now.Add(2 * limit.Window)
+
+	if limit.Algorithm == RateLimitSlidingWindow {
+		return e.takeSlidingWindow(limit, now), nil
+	}
+	return e.takeTokenBucket(limit, now), nil
+}
+
+func (e *rateLimitEntry) takeTokenBucket(limit *RateLimit, now time.Time) *RateLimitResult {
+	capacity := float64(limit.Burst)
+	if capacity <= 0 {
+		capacity = float64(limit.Limit)
+	}
+	rate := float64(limit.Limit) / limit.Window.Seconds()
+
+	if e.updated.IsZero() {
+		e.tokens = capacity
+	} else {
+		e.tokens = math.Min(capacity, e.tokens+now.Sub(e.updated).Seconds()*rate)
+	}
+	e.updated = now
+
+	result := &RateLimitResult{Limit: int(capacity)}
+	if e.tokens >= 1 {
+		e.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsDuration((1 - e.tokens) / rate)
+	}
+	result.Remaining = int(e.tokens)
+	result.Reset = secondsDuration((capacity - e.tokens) / rate)
+	return result
+}
+
+func (e *rateLimitEntry) takeSlidingWindow(limit *RateLimit, now time.Time) *RateLimitResult {
+	start := now.Truncate(limit.Window)
+	if !start.Equal(e.windowStart) {
+		if start.Sub(e.windowStart) == limit.Window {
+			e.previous = e.current
+		} else {
+			e.previous = 0
+		}
+		e.current = 0
+		e.windowStart = start
+	}
+
+	// weight requests of previous window by its part still covered by sliding window
+	elapsed := float64(now.Sub(start)) / float64(limit.Window)
+	estimated := float64(e.previous)*(1-elapsed) + float64(e.current)
+
+	result := &RateLimitResult{Limit: limit.Limit, Reset: start.Add(limit.Window).Sub(now)}
+	if estimated+1 <= float64(limit.Limit) {
+		e.current++
+		estimated++
+		result.Allowed = true
+	} else {
+		result.RetryAfter = result.Reset
+	}
+	result.Remaining = int(math.Max(0, float64(limit.Limit)-math.Ceil(estimated)))
+	return result
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
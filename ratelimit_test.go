@@ -0,0 +1,117 @@
+package webservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDispatchRateLimit(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+		return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+	}
+	ws := buildTestService(map[string]RequestHandlerFunc{"/api/": handler, "/other": handler})
+	ws.RouteRateLimits = map[string]*RateLimit{"/api/": BuildRateLimit(2, time.Minute)}
+	ws.RouteRateLimits["/api/"].Key = RateLimitKeyAPIKey
+
+	do := func(path, remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			r.Header.Set("X-Api-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		ws.dispatch(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := do("/api/items", "10.0.0.1:1000", "alpha"); w.Code != http.StatusOK {
+			t.Fatalf("request %v is limited with %v", i, w.Code)
+		}
+	}
+	w := do("/api/orders", "10.0.0.2:1000", "alpha")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After, got %v %v", w.Code, w.Header())
+	}
+	if w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("RateLimit-Limit") != "2" {
+		t.Fatalf("unexpected rate limit headers %v", w.Header())
+	}
+	if w := do("/api/items", "10.0.0.1:1000", "beta"); w.Code != http.StatusOK {
+		t.Fatalf("another api key is limited with %v", w.Code)
+	}
+	if w := do("/other", "10.0.0.1:1000", "alpha"); w.Code != http.StatusOK {
+		t.Fatalf("route without limit is limited with %v", w.Code)
+	}
+}
+
+func TestSlidingWindowRateLimit(t *testing.T) {
+	limit := BuildRateLimit(3, time.Hour)
+	limit.Algorithm = RateLimitSlidingWindow
+	store := BuildMemoryRateLimitStore()
+
+	for i := 0; i < 3; i++ {
+		if res, err := store.Take("client", limit); err != nil || !res.Allowed {
+			t.Fatalf("request %v is not allowed, %+v %v", i, res, err)
+		}
+	}
+	res, err := store.Take("client", limit)
+	if err != nil || res.Allowed || res.RetryAfter <= 0 {
+		t.Fatalf("expected request to be limited, got %+v %v", res, err)
+	}
+}
+
+func TestRateLimitBeforeSignature(t *testing.T) {
+	conf := BuildSignatureConfig(map[string][]byte{"partner": []byte("secret")})
+	conf.Logger = &logger{level: logLevelError}
+	verifier, err := BuildSignatureVerifier(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := buildTestService(map[string]RequestHandlerFunc{
+		"/orders": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+		},
+	})
+	ws.RouteSignatures = map[string]SignatureVerifier{"/orders": verifier}
+	ws.RateLimit = BuildRateLimit(2, time.Minute)
+	partner := BuildRateLimit(2, time.Minute)
+	partner.Key = RateLimitKeyPrincipal
+	ws.RouteRateLimits = map[string]*RateLimit{"/orders": partner}
+
+	do := func(remoteAddr string, sign bool) int {
+		r := httptest.NewRequest("POST", "/orders", strings.NewReader(`{"id":1}`))
+		r.RemoteAddr = remoteAddr
+		if sign {
+			if err := verifier.Sign(r, "partner"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		w := httptest.NewRecorder()
+		ws.dispatch(w, r)
+		return w.Code
+	}
+
+	// unsigned requests are counted by ip limit before signature is verified
+	for i := 0; i < 2; i++ {
+		if code := do("10.0.0.1:1000", false); code != http.StatusUnauthorized {
+			t.Fatalf("unsigned request %v got %v", i, code)
+		}
+	}
+	if code := do("10.0.0.1:1000", false); code != http.StatusTooManyRequests {
+		t.Fatalf("expected unsigned flood to be limited, got %v", code)
+	}
+
+	// signed requests of a principal are limited across client ips
+	for i := 0; i < 2; i++ {
+		if code := do("10.0.1."+strconv.Itoa(i)+":1000", true); code != http.StatusOK {
+			t.Fatalf("signed request %v got %v", i, code)
+		}
+	}
+	if code := do("10.0.1.9:1000", true); code != http.StatusTooManyRequests {
+		t.Fatalf("expected principal to be limited, got %v", code)
+	}
+}
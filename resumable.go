@@ -0,0 +1,444 @@
+package webservice
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tusVersion = "1.0.0"
+	// statusChecksumMismatch is status defined by tus checksum extension
+	statusChecksumMismatch = 460
+)
+
+// randomIDPattern matches ids generated by randomName, it guards files named by ids against path traversal
+var randomIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// ResumableUploadConfig stores resumable uploads config
+type ResumableUploadConfig struct {
+	// Dir stores data and info files of uploads
+	Dir string
+	// MaxSize limits Upload-Length of an upload, zero means no limit
+	MaxSize int64
+	// Expiration removes uncompleted uploads which are not patched for the duration
+	Expiration      time.Duration
+	CleanupInterval time.Duration
+	// OnComplete is called with the request finishing an upload,
+	// the upload can be got by ResumableUploadFromRequest
+	OnComplete RequestHandlerFunc
+	Logger     Logger
+}
+
+// BuildResumableUploadConfig builds a default resumable uploads config which stores uploads in dir
+func BuildResumableUploadConfig(dir string) *ResumableUploadConfig {
+	return &ResumableUploadConfig{
+		Dir:             dir,
+		MaxSize:         4 << 30,
+		Expiration:      24 * time.Hour,
+		CleanupInterval: time.Hour,
+		Logger:          &logger{},
+	}
+}
+
+// ResumableUpload stores state of a resumable upload
+type ResumableUpload struct {
+	ID        string
+	Length    int64
+	Offset    int64
+	Metadata  map[string]string
+	Path      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// Completed checks whether all bytes of upload are received
+func (u *ResumableUpload) Completed() bool {
+	return u.Offset >= u.Length
+}
+
+// ResumableUploads defines tus protocol uploads interface
+type ResumableUploads interface {
+	// Handler builds handler which should be registered to a route ends with slash
+	Handler() RequestHandlerFunc
+	// Close stops cleanup of abandoned uploads
+	Close() error
+}
+
+// BuildResumableUploads builds resumable uploads object with config
+func BuildResumableUploads(conf *ResumableUploadConfig) (ResumableUploads, error) {
+	if conf == nil || strings.TrimSpace(conf.Dir) == "" {
+		return nil, ErrorInvalidArgument
+	}
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	ru := &resumableUploads{
+		ResumableUploadConfig: *conf,
+		logger:                ConvertLoggerMust(conf.Logger),
+		stop:                  make(chan struct{}),
+	}
+	ru.startCleanup()
+	return ru, nil
+}
+
+// ResumableUploadFromRequest returns upload completed by request passed to OnComplete
+func ResumableUploadFromRequest(r *http.Request) *ResumableUpload {
+	u, _ := r.Context().Value(contextKeyResumableUpload).(*ResumableUpload)
+	return u
+}
+
+type resumableUploads struct {
+	ResumableUploadConfig
+	logger Logger
+	locks  sync.Map
+	stop   chan struct{}
+}
+
+func (ru *resumableUploads) Handler() RequestHandlerFunc {
+	return ru.serve
+}
+
+func (ru *resumableUploads) Close() error {
+	close(ru.stop)
+	return nil
+}
+
+func (ru *resumableUploads) serve(w http.ResponseWriter, r *http.Request, ws WebService) *ServiceResponse {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,checksum,expiration,termination")
+		w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+		if ru.MaxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(ru.MaxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return nil
+	}
+
+	if r.Method == "POST" {
+		return ru.create(w, r)
+	}
+
+	id := path.Base(r.URL.Path)
+	if !randomIDPattern.MatchString(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	unlock := ru.lock(id)
+	defer unlock()
+
+	upload, err := ru.load(id)
+	if err != nil {
+		ru.logger.Trace("load resumable upload", id, "failed with", err)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	switch r.Method {
+	case "HEAD":
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if !upload.ExpiresAt.IsZero() {
+			w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case "PATCH":
+		return ru.patch(w, r, ws, upload)
+	case "DELETE":
+		ru.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return nil
+}
+
+func (ru *resumableUploads) create(w http.ResponseWriter, r *http.Request) *ServiceResponse {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	if ru.MaxSize > 0 && length > ru.MaxSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	id, err := randomName("")
+	if err != nil {
+		ru.logger.Error("generate resumable upload id failed with", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	now := time.Now()
+	upload := &ResumableUpload{
+		ID:        id,
+		Length:    length,
+		Metadata:  parseUploadMetadata(r.Header.Get("Upload-Metadata")),
+		Path:      filepath.Join(ru.Dir, id+".bin"),
+		CreatedAt: now,
+	}
+	if ru.Expiration > 0 {
+		upload.ExpiresAt = now.Add(ru.Expiration)
+	}
+
+	f, err := os.OpenFile(upload.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err == nil {
+		f.Close()
+		err = ru.save(upload)
+	}
+	if err != nil {
+		ru.logger.Error("create resumable upload", id, "failed with", err)
+		ru.remove(id)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+
+	w.Header().Set("Location", singleJoiningSlash(r.URL.Path, id))
+	if !upload.ExpiresAt.IsZero() {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusCreated)
+	ru.logger.Trace("created resumable upload", id, "with length", length)
+	return nil
+}
+
+func (ru *resumableUploads) patch(w http.ResponseWriter, r *http.Request, ws WebService, upload *ResumableUpload) *ServiceResponse {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return nil
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		w.WriteHeader(http.StatusConflict)
+		return nil
+	}
+
+	var checksum hash.Hash
+	var expected []byte
+	if v := r.Header.Get("Upload-Checksum"); v != "" {
+		if checksum, expected, err = parseUploadChecksum(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	f, err := os.OpenFile(upload.Path, os.O_WRONLY, 0640)
+	if err != nil {
+		ru.logger.Error("open resumable upload", upload.ID, "failed with", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+
+	var dst io.Writer = f
+	if checksum != nil {
+		dst = io.MultiWriter(f, checksum)
+	}
+	remaining := upload.Length - offset
+	written, err := io.Copy(dst, io.LimitReader(r.Body, remaining+1))
+	if written > remaining {
+		f.Truncate(offset)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil
+	}
+	if checksum != nil && (err != nil || string(checksum.Sum(nil)) != string(expected)) {
+		// chunk with wrong checksum is discarded entirely
+		f.Truncate(offset)
+		w.WriteHeader(statusChecksumMismatch)
+		return nil
+	}
+	if err != nil {
+		// keep received bytes so that client can resume from them
+		ru.logger.Warn("receive chunk of resumable upload", upload.ID, "failed with", err)
+	}
+
+	upload.Offset = offset + written
+	if ru.Expiration > 0 {
+		upload.ExpiresAt = time.Now().Add(ru.Expiration)
+	}
+	if err := ru.save(upload); err != nil {
+		ru.logger.Error("save resumable upload", upload.ID, "failed with", err)
+		f.Truncate(offset)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if !upload.ExpiresAt.IsZero() {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	if upload.Completed() && ru.OnComplete != nil {
+		ru.logger.Trace("resumable upload", upload.ID, "is completed")
+		rw := wrapResponseWriter(w)
+		ctx := context.WithValue(r.Context(), contextKeyResumableUpload, upload)
+		if resp := ru.OnComplete(rw, r.WithContext(ctx), ws); resp != nil || rw.wroteHeader() {
+			return resp
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (ru *resumableUploads) lock(id string) func() {
+	v, _ := ru.locks.LoadOrStore(id, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (ru *resumableUploads) infoPath(id string) string {
+	return filepath.Join(ru.Dir, id+".info")
+}
+
+func (ru *resumableUploads) load(id string) (*ResumableUpload, error) {
+	data, err := ioutil.ReadFile(ru.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	upload := &ResumableUpload{}
+	if err = json.Unmarshal(data, upload); err != nil {
+		return nil, err
+	}
+	if !upload.Completed() && !upload.ExpiresAt.IsZero() && time.Now().After(upload.ExpiresAt) {
+		return nil, ErrorNotFound
+	}
+	return upload, nil
+}
+
+// save writes info file atomically
+func (ru *resumableUploads) save(upload *ResumableUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	tmp := ru.infoPath(upload.ID) + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ru.infoPath(upload.ID))
+}
+
+func (ru *resumableUploads) remove(id string) {
+	os.Remove(filepath.Join(ru.Dir, id+".bin"))
+	os.Remove(ru.infoPath(id))
+	ru.locks.Delete(id)
+}
+
+func (ru *resumableUploads) startCleanup() {
+	if ru.Expiration <= 0 {
+		return
+	}
+	interval := ru.CleanupInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ru.stop:
+				return
+			case <-ticker.C:
+				ru.cleanup()
+			}
+		}
+	}()
+}
+
+// cleanup removes expired uploads which are not completed
+func (ru *resumableUploads) cleanup() {
+	infos, err := filepath.Glob(filepath.Join(ru.Dir, "*.info"))
+	if err != nil {
+		ru.logger.Warn("scan resumable uploads failed with", err)
+		return
+	}
+
+	now := time.Now()
+	for _, info := range infos {
+		id := strings.TrimSuffix(filepath.Base(info), ".info")
+		unlock := ru.lock(id)
+		data, err := ioutil.ReadFile(info)
+		upload := &ResumableUpload{}
+		if err == nil && json.Unmarshal(data, upload) == nil &&
+			!upload.Completed() && !upload.ExpiresAt.IsZero() && now.After(upload.ExpiresAt) {
+			ru.logger.Trace("remove expired resumable upload", id)
+			ru.remove(id)
+		}
+		unlock()
+	}
+}
+
+// parseUploadMetadata parses comma separated keys with base64 encoded values
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			if data, err := base64.StdEncoding.DecodeString(fields[1]); err == nil {
+				value = string(data)
+			}
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata
+}
+
+// parseUploadChecksum parses Upload-Checksum header as algorithm and base64 encoded digest
+func parseUploadChecksum(header string) (hash.Hash, []byte, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return nil, nil, ErrorInvalidArgument
+	}
+	expected, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "md5":
+		return md5.New(), expected, nil
+	case "sha1":
+		return sha1.New(), expected, nil
+	case "sha256":
+		return sha256.New(), expected, nil
+	}
+	return nil, nil, ErrorInvalidArgument
+}
@@ -0,0 +1,88 @@
+package webservice
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestResumableUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resumable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var completed *ResumableUpload
+	conf := BuildResumableUploadConfig(dir)
+	conf.Logger = &logger{level: logLevelError}
+	conf.OnComplete = func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+		completed = ResumableUploadFromRequest(r)
+		return nil
+	}
+	uploads, err := BuildResumableUploads(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uploads.Close()
+	handler := uploads.Handler()
+
+	do := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Tus-Resumable", tusVersion)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r, nil)
+		return w
+	}
+	patch := func(location, offset, chunk, checksum string) *httptest.ResponseRecorder {
+		return do("PATCH", location, chunk, map[string]string{
+			"Content-Type":    "application/offset+octet-stream",
+			"Upload-Offset":   offset,
+			"Upload-Checksum": checksum,
+		})
+	}
+	sha := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	w := do("POST", "/files/", "", map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("hello.txt")),
+	})
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusCreated || !strings.HasPrefix(location, "/files/") {
+		t.Fatalf("unexpected creation response %v %v", w.Code, location)
+	}
+
+	if w = patch(location, "0", "hello", sha("hello")); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("unexpected patch response %v %v", w.Code, w.Header())
+	}
+	if w = patch(location, "5", " world", sha("broken")); w.Code != statusChecksumMismatch {
+		t.Fatalf("expected checksum mismatch, got %v", w.Code)
+	}
+	if w = patch(location, "0", " world", ""); w.Code != http.StatusConflict {
+		t.Fatalf("expected offset conflict, got %v", w.Code)
+	}
+	if w = do("HEAD", location, "", nil); w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("unexpected offset %v", w.Header().Get("Upload-Offset"))
+	}
+	if w = patch(location, "5", " world", sha(" world")); w.Code != http.StatusNoContent {
+		t.Fatalf("unexpected patch response %v", w.Code)
+	}
+
+	if completed == nil || completed.Metadata["filename"] != "hello.txt" {
+		t.Fatalf("completion callback is not called with upload, got %+v", completed)
+	}
+	if data, _ := ioutil.ReadFile(completed.Path); string(data) != "hello world" {
+		t.Fatalf("unexpected upload data %q", data)
+	}
+}
@@ -0,0 +1,256 @@
+package webservice
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxBodyHookSize is max upstream response body size passed to body hook by default
+const defaultMaxBodyHookSize = 4 << 20
+
+// PathRewrite rewrites request path matched by Pattern to Replacement,
+// Replacement can refer submatches as $1 or ${name}
+type PathRewrite struct {
+	Pattern     string
+	Replacement string
+}
+
+// FieldRules defines add, set and remove operations on header or query fields,
+// removing is applied first and adding is applied last
+type FieldRules struct {
+	Add    map[string]string
+	Set    map[string]string
+	Remove []string
+}
+
+// RewriteRules defines rewriting of requests forwarded by a proxy route and their responses
+type RewriteRules struct {
+	// Paths are tried in order and the first matched one is applied to path after prefix stripped
+	Paths []PathRewrite
+	// Host overrides Host header sent to upstream
+	Host            string
+	RequestHeaders  FieldRules
+	Query           FieldRules
+	ResponseHeaders FieldRules
+	// CookieDomains maps domain of upstream Set-Cookie to public domain, key "*" matches any domain
+	CookieDomains map[string]string
+	// CookiePaths maps path prefix of upstream Set-Cookie to public path prefix
+	CookiePaths map[string]string
+	// RewriteLocation rewrites Location and Content-Location pointing to upstream to public host,
+	// strip prefix of route is added back to rewritten paths
+	RewriteLocation bool
+	// RequestHook is called with request which will be sent to upstream
+	RequestHook func(out *http.Request) error
+	// ResponseHook is called with upstream response before it is copied to client
+	ResponseHook func(resp *http.Response) error
+	// BodyHook replaces upstream response body, body is passed as upstream sent it
+	// without decoding Content-Encoding and larger bodies than MaxBodyHookSize are not passed
+	BodyHook        func(resp *http.Response, body []byte) ([]byte, error)
+	MaxBodyHookSize int64
+}
+
+type pathRewriter struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// rewriter is compiled rewrite rules of a proxy route
+type rewriter struct {
+	*RewriteRules
+	paths  []pathRewriter
+	prefix string
+}
+
+func compileRewriteRules(rules *RewriteRules, prefix string) (*rewriter, error) {
+	if rules == nil {
+		return nil, nil
+	}
+
+	rw := &rewriter{RewriteRules: rules, prefix: prefix}
+	for _, p := range rules.Paths {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		rw.paths = append(rw.paths, pathRewriter{pattern: re, replacement: p.Replacement})
+	}
+	return rw, nil
+}
+
+func (rw *rewriter) rewritePath(path string) string {
+	if rw == nil {
+		return path
+	}
+	for _, p := range rw.paths {
+		if p.pattern.MatchString(path) {
+			return p.pattern.ReplaceAllString(path, p.replacement)
+		}
+	}
+	return path
+}
+
+// rewriteRequest applies host, header, query rules and request hook to upstream request
+func (rw *rewriter) rewriteRequest(out *http.Request) error {
+	if rw == nil {
+		return nil
+	}
+
+	if rw.Host != "" {
+		out.Host = rw.Host
+	}
+	applyHeaderRules(out.Header, &rw.RequestHeaders)
+
+	if len(rw.Query.Add)+len(rw.Query.Set)+len(rw.Query.Remove) > 0 {
+		query := out.URL.Query()
+		for _, k := range rw.Query.Remove {
+			query.Del(k)
+		}
+		for k, v := range rw.Query.Set {
+			query.Set(k, v)
+		}
+		for k, v := range rw.Query.Add {
+			query.Add(k, v)
+		}
+		out.URL.RawQuery = query.Encode()
+	}
+
+	if rw.RequestHook != nil {
+		return rw.RequestHook(out)
+	}
+	return nil
+}
+
+// rewriteResponse applies response rules and hooks to upstream response of request r
+func (rw *rewriter) rewriteResponse(resp *http.Response, r *http.Request) error {
+	if rw == nil {
+		return nil
+	}
+
+	applyHeaderRules(resp.Header, &rw.ResponseHeaders)
+	if len(rw.CookieDomains)+len(rw.CookiePaths) > 0 {
+		rw.rewriteCookies(resp)
+	}
+	if rw.RewriteLocation && resp.Request != nil {
+		for _, k := range []string{"Location", "Content-Location"} {
+			if v := resp.Header.Get(k); v != "" {
+				resp.Header.Set(k, rw.rewriteLocation(v, resp.Request, r))
+			}
+		}
+	}
+
+	if rw.ResponseHook != nil {
+		if err := rw.ResponseHook(resp); err != nil {
+			return err
+		}
+	}
+	if rw.BodyHook != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+		return rw.rewriteBody(resp)
+	}
+	return nil
+}
+
+func (rw *rewriter) rewriteCookies(resp *http.Response) {
+	cookies := resp.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+
+	resp.Header.Del("Set-Cookie")
+	for _, c := range cookies {
+		if c.Domain != "" {
+			if d, ok := rw.CookieDomains[strings.TrimPrefix(c.Domain, ".")]; ok {
+				c.Domain = d
+			} else if d, ok := rw.CookieDomains["*"]; ok {
+				c.Domain = d
+			}
+		}
+		longest := ""
+		for from := range rw.CookiePaths {
+			if strings.HasPrefix(c.Path, from) && len(from) > len(longest) {
+				longest = from
+			}
+		}
+		if longest != "" {
+			c.Path = rw.CookiePaths[longest] + c.Path[len(longest):]
+		}
+		resp.Header.Add("Set-Cookie", c.String())
+	}
+}
+
+// rewriteLocation rewrites location responded to upstream request out for incoming request r
+func (rw *rewriter) rewriteLocation(location string, out, r *http.Request) string {
+	loc, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if loc.IsAbs() && !strings.EqualFold(loc.Host, out.URL.Host) && !strings.EqualFold(loc.Host, out.Host) {
+		// redirects to other sites are kept
+		return location
+	}
+
+	if loc.IsAbs() {
+		loc.Scheme = "http"
+		if r.TLS != nil {
+			loc.Scheme = "https"
+		}
+		loc.Host = r.Host
+	}
+	if rw.prefix != "" && strings.HasPrefix(loc.Path, "/") {
+		loc.Path = singleJoiningSlash(rw.prefix, loc.Path)
+		loc.RawPath = ""
+	}
+	return loc.String()
+}
+
+func (rw *rewriter) rewriteBody(resp *http.Response) error {
+	limit := rw.MaxBodyHookSize
+	if limit <= 0 {
+		limit = defaultMaxBodyHookSize
+	}
+	if resp.ContentLength > limit {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > limit {
+		// too large to rewrite, stream it as it is
+		resp.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(data), resp.Body), Closer: resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	data, err = rw.BodyHook(resp, data)
+	if err != nil {
+		return err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+func applyHeaderRules(h http.Header, rules *FieldRules) {
+	for _, k := range rules.Remove {
+		h.Del(k)
+	}
+	for k, v := range rules.Set {
+		h.Set(k, v)
+	}
+	for k, v := range rules.Add {
+		h.Add(k, v)
+	}
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
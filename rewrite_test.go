@@ -0,0 +1,111 @@
+package webservice
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyRouteRewrite(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/legacy/users/42" || r.URL.Query().Get("v") != "2" || r.URL.Query().Get("debug") != "" {
+			t.Errorf("unexpected upstream url %v", r.URL)
+		}
+		if r.Host != "legacy.internal" || r.Header.Get("X-Team") != "core" || r.Header.Get("Cookie") != "" {
+			t.Errorf("unexpected upstream request host %v headers %v", r.Host, r.Header)
+		}
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "1", Domain: "legacy.internal", Path: "/legacy"})
+		w.Header().Set("Location", "http://"+r.Host+"/legacy/users/43")
+		w.Header().Set("Server", "legacy")
+		w.Write([]byte("hello legacy"))
+	}))
+	defer upstream.Close()
+
+	p := BuildHTTPProxy(nil)
+	defer p.Close()
+	if err := p.AddUpstreamPool(BuildUpstreamPoolConfig("legacy", upstream.URL)); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := p.RouteHandler(&ProxyRoute{
+		Pool:        "legacy",
+		StripPrefix: "/api",
+		Rewrite: &RewriteRules{
+			Paths:           []PathRewrite{{Pattern: `^/users/(\d+)$`, Replacement: "/legacy/users/$1"}},
+			Host:            "legacy.internal",
+			RequestHeaders:  FieldRules{Set: map[string]string{"X-Team": "core"}, Remove: []string{"Cookie"}},
+			Query:           FieldRules{Set: map[string]string{"v": "2"}, Remove: []string{"debug"}},
+			ResponseHeaders: FieldRules{Remove: []string{"Server"}},
+			CookieDomains:   map[string]string{"legacy.internal": "example.com"},
+			CookiePaths:     map[string]string{"/legacy": "/api"},
+			RewriteLocation: true,
+			BodyHook: func(resp *http.Response, body []byte) ([]byte, error) {
+				return bytes.Replace(body, []byte("legacy"), []byte("world"), -1), nil
+			},
+		},
+	})
+
+	r := httptest.NewRequest("GET", "http://example.com/api/users/42?debug=1", nil)
+	r.Header.Set("Cookie", "a=b")
+	w := httptest.NewRecorder()
+	handler(w, r, nil)
+
+	if w.Body.String() != "hello world" {
+		t.Fatalf("unexpected body %q", w.Body.String())
+	}
+	if loc := w.Header().Get("Location"); loc != "http://example.com/api/legacy/users/43" {
+		t.Fatalf("unexpected location %q", loc)
+	}
+	if c := w.Header().Get("Set-Cookie"); c != "sid=1; Path=/api; Domain=example.com" {
+		t.Fatalf("unexpected cookie %q", c)
+	}
+	if w.Header().Get("Server") != "" {
+		t.Fatalf("response header is not removed")
+	}
+}
+
+func TestProxyRouteRequestHookError(t *testing.T) {
+	hits := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer upstream.Close()
+
+	p := BuildHTTPProxy(nil)
+	defer p.Close()
+	conf := BuildUpstreamPoolConfig("api", upstream.URL)
+	conf.MaxFails = 1
+	if err := p.AddUpstreamPool(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	fail := true
+	handler := p.RouteHandler(&ProxyRoute{Pool: "api", Rewrite: &RewriteRules{
+		RequestHook: func(out *http.Request) error {
+			if fail {
+				return ErrorInvalidArgument
+			}
+			return nil
+		},
+	}})
+	do := func() int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/users", nil), nil)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := do(); code != http.StatusInternalServerError {
+			t.Fatalf("expected rewrite error to respond 500, got %v", code)
+		}
+	}
+	if hits != 0 {
+		t.Fatalf("request failed to rewrite is sent %v times", hits)
+	}
+	// upstream is neither ejected nor blamed by local errors
+	fail = false
+	if code := do(); code != http.StatusOK || hits != 1 {
+		t.Fatalf("healthy upstream got %v with %v hits", code, hits)
+	}
+}
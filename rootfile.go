@@ -0,0 +1,114 @@
+package webservice
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// RootFile is a single file served on a root path, such as /favicon.ico or /robots.txt
+type RootFile struct {
+	// Path is file on disk, Data is served instead if it is not nil, such as embedded bytes
+	Path string
+	Data []byte
+	// ContentType is detected by extension of url path if it is empty
+	ContentType  string
+	CacheControl string
+}
+
+// rootFileHandler serves one root file with cache headers
+type rootFileHandler struct {
+	RootFile
+	name   string
+	etag   string
+	logger Logger
+}
+
+// buildRootFiles builds handlers of root files keyed by url path, files without source are skipped
+func buildRootFiles(files map[string]*RootFile, log Logger) map[string]http.Handler {
+	handlers := make(map[string]http.Handler, len(files))
+	for urlPath, file := range files {
+		if file == nil || (file.Data == nil && file.Path == "") {
+			log.Warn("root file", urlPath, "has neither path nor data, it is not served")
+			continue
+		}
+		h := &rootFileHandler{RootFile: *file, name: path.Base(urlPath), logger: log}
+		if h.ContentType == "" {
+			h.ContentType = mime.TypeByExtension(path.Ext(urlPath))
+		}
+		if h.Data != nil {
+			h.etag = contentETag(h.Data)
+		}
+		handlers[urlPath] = h
+	}
+	return handlers
+}
+
+func (h *rootFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var content io.ReadSeeker
+	var modTime time.Time
+	etag := h.etag
+	if h.Data != nil {
+		content = bytes.NewReader(h.Data)
+	} else {
+		// file is read on each request so that it can be replaced without restart
+		data, info, err := readFileInfo(h.Path)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			h.logger.Error("read root file", h.Path, "failed with", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		modTime = info.ModTime()
+		content, etag = bytes.NewReader(data), contentETag(data)
+	}
+
+	header := w.Header()
+	header.Set("ETag", etag)
+	if h.ContentType != "" {
+		header.Set("Content-Type", h.ContentType)
+	}
+	if h.CacheControl != "" {
+		header.Set("Cache-Control", h.CacheControl)
+	}
+	http.ServeContent(w, r, h.name, modTime, content)
+}
+
+// readFileInfo reads file and its info from one open file
+func readFileInfo(name string) ([]byte, os.FileInfo, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return nil, info, err
+	}
+	data, err := io.ReadAll(f)
+	return data, info, err
+}
+
+// contentETag returns strong etag of data
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
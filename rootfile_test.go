@@ -0,0 +1,73 @@
+package webservice
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRootFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	robots := filepath.Join(dir, "robots.txt")
+	ioutil.WriteFile(robots, []byte("User-agent: *\n"), 0600)
+
+	ws := buildTestService(nil)
+	ws.RootFiles = map[string]*RootFile{
+		"/favicon.ico": {Data: []byte("icon"), CacheControl: "public, max-age=86400"},
+		"/robots.txt":  {Path: robots},
+		"/humans.txt":  {Path: filepath.Join(dir, "humans.txt")},
+		"/empty.txt":   {},
+	}
+	ws.initRequestLayers()
+	if len(ws.rootFiles) != 3 {
+		t.Fatal("unexpected root files", ws.rootFiles)
+	}
+
+	do := func(method, path string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		ws.dispatch(w, r)
+		return w
+	}
+
+	w := do("GET", "/favicon.ico", nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != "icon" || etag == "" ||
+		w.Header().Get("Cache-Control") != "public, max-age=86400" || w.Header().Get("Content-Type") != "image/vnd.microsoft.icon" {
+		t.Fatal("unexpected favicon", w.Code, w.Body.String(), w.Header())
+	}
+	if w = do("GET", "/favicon.ico", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Fatal("expected not modified, got", w.Code)
+	}
+	if w = do("POST", "/favicon.ico", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Fatal("unexpected status of post", w.Code)
+	}
+
+	if w = do("GET", "/robots.txt", nil); w.Code != http.StatusOK || w.Body.String() != "User-agent: *\n" ||
+		w.Header().Get("Content-Type") != "text/plain; charset=utf-8" || w.Header().Get("Last-Modified") == "" {
+		t.Fatal("unexpected robots.txt", w.Code, w.Body.String(), w.Header())
+	}
+	// file is replaced without restart
+	ioutil.WriteFile(robots, []byte("User-agent: *\nDisallow: /\n"), 0600)
+	if w = do("GET", "/robots.txt", nil); w.Body.String() != "User-agent: *\nDisallow: /\n" {
+		t.Fatal("replaced file is not served", w.Body.String())
+	}
+	if w = do("GET", "/humans.txt", nil); w.Code != http.StatusNotFound {
+		t.Fatal("missing file is served", w.Code)
+	}
+
+	// working directory is not exposed
+	if w = do("GET", "/go.mod", nil); w.Code == http.StatusOK {
+		t.Fatal("file of working directory is served", w.Body.String())
+	}
+}
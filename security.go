@@ -0,0 +1,282 @@
+package webservice
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecurityHeaders stores security headers added to all responses,
+// headers already set by handlers or upstreams are kept
+type SecurityHeaders struct {
+	// HSTSMaxAge enables Strict-Transport-Security for tls requests
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+	ContentSecurityPolicy string
+	// CSPNonce adds a nonce of each request to script-src and style-src of policy,
+	// the nonce can be got by CSPNonceFromRequest or cspNonce template func
+	CSPNonce bool
+	// CSPReportOnly sends policy in Content-Security-Policy-Report-Only
+	CSPReportOnly      bool
+	FrameOptions       string
+	ContentTypeNosniff bool
+	ReferrerPolicy     string
+	PermissionsPolicy  string
+	CrossOriginOpener  string
+	Custom             map[string]string
+}
+
+// BuildSecurityHeaders builds default security headers
+func BuildSecurityHeaders() *SecurityHeaders {
+	return &SecurityHeaders{
+		HSTSMaxAge:            180 * 24 * time.Hour,
+		HSTSIncludeSubdomains: true,
+		ContentSecurityPolicy: "default-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'",
+		CSPNonce:              true,
+		FrameOptions:          "DENY",
+		ContentTypeNosniff:    true,
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+		PermissionsPolicy:     "camera=(), microphone=(), geolocation=()",
+		CrossOriginOpener:     "same-origin",
+	}
+}
+
+// apply sets headers which are not set yet
+func (sh *SecurityHeaders) apply(header http.Header, r *http.Request, nonce string) {
+	set := func(name, value string) {
+		if value != "" && header.Get(name) == "" {
+			header.Set(name, value)
+		}
+	}
+
+	if sh.HSTSMaxAge > 0 && r.TLS != nil {
+		hsts := "max-age=" + strconv.FormatInt(int64(sh.HSTSMaxAge/time.Second), 10)
+		if sh.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if sh.HSTSPreload {
+			hsts += "; preload"
+		}
+		set("Strict-Transport-Security", hsts)
+	}
+	if sh.ContentSecurityPolicy != "" {
+		policy := sh.ContentSecurityPolicy
+		if nonce != "" {
+			policy = cspWithNonce(policy, nonce)
+		}
+		if sh.CSPReportOnly {
+			set("Content-Security-Policy-Report-Only", policy)
+		} else {
+			set("Content-Security-Policy", policy)
+		}
+	}
+	set("X-Frame-Options", sh.FrameOptions)
+	if sh.ContentTypeNosniff {
+		set("X-Content-Type-Options", "nosniff")
+	}
+	set("Referrer-Policy", sh.ReferrerPolicy)
+	set("Permissions-Policy", sh.PermissionsPolicy)
+	set("Cross-Origin-Opener-Policy", sh.CrossOriginOpener)
+	for name, value := range sh.Custom {
+		set(name, value)
+	}
+}
+
+// cspWithNonce adds nonce source to script-src and style-src directives, the directives are derived
+// from default-src if policy has none of them. Directives of 'none' are kept as they are,
+// since adding source to them would allow more than policy does
+func cspWithNonce(policy, nonce string) string {
+	source := "'nonce-" + nonce + "'"
+	directives := strings.Split(policy, ";")
+	has := map[string]bool{}
+	var defaultSrc []string
+	for i, d := range directives {
+		fields := strings.Fields(d)
+		if len(fields) == 0 {
+			directives[i] = ""
+			continue
+		}
+		switch name := strings.ToLower(fields[0]); name {
+		case "script-src", "style-src":
+			has[name] = true
+			fields = withCSPSource(fields, source)
+		case "default-src":
+			defaultSrc = fields[1:]
+		}
+		directives[i] = strings.Join(fields, " ")
+	}
+	for _, name := range []string{"script-src", "style-src"} {
+		if has[name] || defaultSrc == nil {
+			continue
+		}
+		// the directive is restricted by default-src, so it allows the same sources and nonce
+		if fields := withCSPSource(append([]string{name}, defaultSrc...), source); fields[len(fields)-1] == source {
+			directives = append(directives, strings.Join(fields, " "))
+		}
+	}
+
+	parts := directives[:0]
+	for _, d := range directives {
+		if d != "" {
+			parts = append(parts, d)
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// withCSPSource adds source to fields of directive unless directive allows nothing
+func withCSPSource(fields []string, source string) []string {
+	if len(fields) == 2 && strings.EqualFold(fields[1], "'none'") {
+		return fields
+	}
+	return append(fields, source)
+}
+
+// requestState stores values of a request shared by layers of web service and templates
+type requestState struct {
+	cspNonce  string
+	csrf      *csrfHolder
+	csrfField string
+	session   *sessionHolder
+	// used is set once nonce, csrf token or session is read, response depending on them
+	// can not be shared by cache
+	used bool
+}
+
+// nonce returns csp nonce of request
+func (state *requestState) nonce() string {
+	if state == nil || state.cspNonce == "" {
+		return ""
+	}
+	state.used = true
+	return state.cspNonce
+}
+
+// csrfToken returns csrf token of request, it is issued at first call if client has none
+func (state *requestState) csrfToken() string {
+	if state == nil {
+		return ""
+	}
+	token := state.csrf.get()
+	if token != "" {
+		state.used = true
+	}
+	return token
+}
+
+// sessionOf returns session of request, it is nil if sessions are disabled
+func (state *requestState) sessionOf() *Session {
+	if state == nil || state.session == nil {
+		return nil
+	}
+	state.used = true
+	return state.session.get()
+}
+
+func requestStateFromRequest(r *http.Request) *requestState {
+	state, _ := r.Context().Value(contextKeyRequestState).(*requestState)
+	return state
+}
+
+// CSPNonceFromRequest returns csp nonce of request, it is empty if nonce is disabled
+func CSPNonceFromRequest(r *http.Request) string {
+	return requestStateFromRequest(r).nonce()
+}
+
+// stateWriter carries request state to templates rendered into it,
+// and sets security headers before response header is written
+type stateWriter struct {
+	http.ResponseWriter
+	state  *requestState
+	before func()
+}
+
+func (sw *stateWriter) writeBefore() {
+	if sw.before != nil {
+		before := sw.before
+		sw.before = nil
+		before()
+	}
+}
+
+func (sw *stateWriter) WriteHeader(status int) {
+	sw.writeBefore()
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *stateWriter) Write(data []byte) (int, error) {
+	sw.writeBefore()
+	return sw.ResponseWriter.Write(data)
+}
+
+func (sw *stateWriter) Flush() {
+	sw.writeBefore()
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *stateWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+// Unwrap returns wrapped writer
+func (sw *stateWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// requestStateOfWriter finds request state carried by writer or writers wrapped by it
+func requestStateOfWriter(w http.ResponseWriter) *requestState {
+	for w != nil {
+		if sw, ok := w.(*stateWriter); ok {
+			return sw.state
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+	return nil
+}
+
+// withRequestState wraps handler of server so that all responses, including statics,
+// carry request state and security headers
+func (ws *webService) withRequestState(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := &requestState{}
+		sw := &stateWriter{ResponseWriter: w, state: state}
+		if sh := ws.SecurityHeaders; sh != nil {
+			if sh.CSPNonce && sh.ContentSecurityPolicy != "" {
+				nonce, err := randomNonce()
+				if err != nil {
+					ws.Logger.Error("generate csp nonce failed with", err)
+				}
+				state.cspNonce = nonce
+			}
+			sw.before = func() { sh.apply(w.Header(), r, state.cspNonce) }
+		}
+
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), contextKeyRequestState, state)))
+	})
+}
+
+// randomNonce returns url safe base64 encoded 16 random bytes, it needs no escaping in html
+func randomNonce() (string, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,75 @@
+package webservice
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeadersAndTemplateNonce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	page := `<script nonce="{{cspNonce}}">run()</script>`
+	if err := ioutil.WriteFile(filepath.Join(dir, "page.html"), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := buildTestService(nil)
+	ws.SecurityHeaders = BuildSecurityHeaders()
+	ws.templatesManager = buildTemplatesManager(dir, "*.html", "", "", ws.Logger)
+
+	var nonce string
+	handler := ws.withRequestState(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = CSPNonceFromRequest(r)
+		if r.URL.Path == "/framed" {
+			w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		}
+		if err := ws.TemplatesManager().RenderTemplate(w, "page.html", nil); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+		if nonce == "" || !strings.Contains(w.Body.String(), `nonce="`+nonce+`"`) {
+			t.Fatalf("nonce %q is not rendered in %q", nonce, w.Body.String())
+		}
+		if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "'nonce-"+nonce+"'") {
+			t.Fatalf("nonce is not in policy %q", csp)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Strict-Transport-Security") != "" {
+			t.Fatalf("unexpected headers %v", w.Header())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/framed", nil))
+	if w.Header().Get("X-Frame-Options") != "SAMEORIGIN" {
+		t.Fatalf("header set by handler is overridden, got %v", w.Header().Get("X-Frame-Options"))
+	}
+}
+
+func TestCSPWithNonce(t *testing.T) {
+	for policy, expected := range map[string]string{
+		"default-src 'self'; object-src 'none'": "default-src 'self'; object-src 'none'; script-src 'self' 'nonce-n'; style-src 'self' 'nonce-n'",
+		"default-src 'none'":                    "default-src 'none'",
+		"default-src 'none'; script-src 'none'": "default-src 'none'; script-src 'none'",
+		"default-src 'none'; style-src 'self'":  "default-src 'none'; style-src 'self' 'nonce-n'",
+		"script-src https://cdn.example.com;":   "script-src https://cdn.example.com 'nonce-n'",
+		"img-src *":                             "img-src *",
+		"default-src https:; style-src 'self'":  "default-src https:; style-src 'self' 'nonce-n'; script-src https: 'nonce-n'",
+		"default-src 'self'; script-src 'self'": "default-src 'self'; script-src 'self' 'nonce-n'; style-src 'self' 'nonce-n'",
+	} {
+		if csp := cspWithNonce(policy, "n"); csp != expected {
+			t.Errorf("policy %q got %q, expected %q", policy, csp, expected)
+		}
+	}
+}
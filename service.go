@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"strings"
@@ -15,17 +16,22 @@ import (
 // webService provides web service
 type webService struct {
 	Config
-	server           *http.Server
-	templatesManager *templatesManager
-	watcher          *fsnotify.Watcher
-}
-
-var (
-	faviconHandler http.Handler
-)
-
-func init() {
-	faviconHandler = http.StripPrefix("/", http.FileServer(http.Dir("./")))
+	server            *http.Server
+	templatesManager  *templatesManager
+	watcher           *fsnotify.Watcher
+	concurrency       *concurrency
+	csrf              *csrfProtector
+	sessions          *sessionManager
+	certificates      *certificateManager
+	clientAuth        *clientAuthenticator
+	acme              *acmeManager
+	listeners         []serviceListener
+	redirectServer    *http.Server
+	redirectListeners []net.Listener
+	http3Server       HTTP3Server
+	http3Conn         net.PacketConn
+	http3Handler      http.Handler
+	rootFiles         map[string]http.Handler
 }
 
 func (ws *webService) PagesTempLatesDir() string {
@@ -36,6 +42,10 @@ func (ws *webService) WidgetsTempLatesDir() string {
 	return ws.Config.WidgetsTempLatesDir
 }
 
+func (ws *webService) UploadsDir() string {
+	return ws.Config.UploadsDir
+}
+
 func (ws *webService) TemplatesManager() TemplatesManager {
 	return ws.templatesManager
 }
@@ -50,21 +60,36 @@ func (ws *webService) initAndServe(
 		ws.Logger = &logger{}
 	}
 
-	ws.initTemplatesManager()
-
 	webAddr := fmt.Sprintf("%v:%v", conf.WebAddr, conf.Port)
 	// init http server
 	ws.server = &http.Server{
-		Addr:         webAddr,
-		ReadTimeout:  conf.ReadTimeout,
-		WriteTimeout: conf.WriteTimeout,
-		TLSConfig:    nil,
+		Addr:              webAddr,
+		ReadTimeout:       conf.ReadTimeout,
+		ReadHeaderTimeout: conf.ReadHeaderTimeout,
+		WriteTimeout:      conf.WriteTimeout,
+		IdleTimeout:       conf.IdleTimeout,
+		MaxHeaderBytes:    conf.MaxHeaderBytes,
 	}
 
+	// certificates are loaded before watcher so that their directories are watched
+	ws.initTLS()
+	ws.initProtocols()
+	ws.initTemplatesManager()
+	ws.initRequestLayers()
+
 	mux := http.NewServeMux()
 	// add static directory
 	for p, d := range conf.Statics {
-		mux.Handle(p, http.StripPrefix(p, http.FileServer(http.Dir(d))))
+		static := BuildStaticConfig(d)
+		static.Logger = ws.Logger
+		mux.Handle(p, http.StripPrefix(p, BuildStaticHandler(static)))
+	}
+	for p, static := range conf.StaticFiles {
+		static := *static
+		if static.Logger == nil {
+			static.Logger = ws.Logger
+		}
+		mux.Handle(p, http.StripPrefix(p, BuildStaticHandler(&static)))
 	}
 	// add handler func
 	mux.HandleFunc("/", ws.dispatch)
@@ -77,7 +102,16 @@ func (ws *webService) initAndServe(
 		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	}
 
-	ws.server.Handler = mux
+	ws.server.Handler = ws.withRequestState(mux)
+	if ws.acme != nil {
+		// challenges are answered before any layer of web service
+		ws.server.Handler = ws.acme.httpHandler(ws.server.Handler)
+	}
+
+	if err := ws.listen(); err != nil {
+		ws.Logger.Error("start web service", ws.ServiceAddr(), "with error", err)
+		panic(err)
+	}
 
 	// start web service asynchronously
 	go ws.run()
@@ -114,6 +148,35 @@ func (ws *webService) initTemplatesManager() {
 			panic(err)
 		}
 	}
+	for dir := range ws.tlsWatchedDirs() {
+		if err = ws.watcher.Add(dir); err != nil {
+			ws.Logger.Warn(dir, "is added watcher failed with", err, "certificates in it are not reloaded")
+		}
+	}
+}
+
+// initRequestLayers builds states of layers applied to requests by dispatch
+func (ws *webService) initRequestLayers() {
+	ws.concurrency = buildConcurrency(&ws.Config)
+	ws.rootFiles = buildRootFiles(ws.RootFiles, ws.Logger)
+
+	if ws.CSRF != nil {
+		var err error
+		ws.csrf, err = buildCSRFProtector(ws.CSRF, ws.Logger)
+		if err != nil {
+			ws.Logger.Error("build csrf protector failed with", err)
+			panic(err)
+		}
+	}
+
+	if ws.Sessions != nil {
+		var err error
+		ws.sessions, err = buildSessionManager(ws.Sessions, ws.Logger)
+		if err != nil {
+			ws.Logger.Error("build session manager failed with", err)
+			panic(err)
+		}
+	}
 }
 
 func (ws *webService) watcherEventsHandler() {
@@ -127,6 +190,20 @@ func (ws *webService) watcherEventsHandler() {
 				return
 			}
 			ws.Logger.Trace("fsnotify watcher event", event)
+			reloaded := false
+			if ws.certificates.watches(event.Name) {
+				ws.Logger.Trace("reload certificates of web service", ws.ServiceAddr())
+				ws.certificates.reload()
+				reloaded = true
+			}
+			if ws.clientAuth.watches(event.Name) {
+				ws.Logger.Trace("reload crl of web service", ws.ServiceAddr())
+				ws.clientAuth.reload()
+				reloaded = true
+			}
+			if reloaded {
+				continue
+			}
 			if event.Op&( /*fsnotify.Write|*/ fsnotify.Remove|fsnotify.Create|fsnotify.Rename|fsnotify.Chmod) > 0 &&
 				pagePattern != "" && pagesTemplatesDir != "" {
 				ws.Logger.Trace("refresh page templates of web service", ws.ServiceAddr())
@@ -145,29 +222,21 @@ func (ws *webService) watcherEventsHandler() {
 }
 
 func (ws *webService) run() {
-	var err error
-	if strings.TrimSpace(ws.TLSCert) == "" ||
-		strings.TrimSpace(ws.TLSKey) == "" {
-		// there is not tls cert and key file info, just start http service
-		ws.Logger.Trace("ListenAndServe for", ws.ServiceAddr())
-		err = ws.server.ListenAndServe()
-	} else {
-		ws.Logger.Trace("ListenAndServeTLS for", ws.ServiceAddr())
-		err = ws.server.ListenAndServeTLS(strings.TrimSpace(ws.TLSCert), strings.TrimSpace(ws.TLSKey))
-	}
-
-	if err != nil && err != http.ErrServerClosed {
-		ws.Logger.Error("start web service", ws.ServiceAddr(), "with error", err)
-		panic(err)
+	if ws.acme != nil {
+		ws.acme.start()
 	}
 
-	ws.Logger.Trace("web service", ws.ServiceAddr(), "is stopped", err)
+	ws.serve()
+	ws.Logger.Trace("web service", ws.ServiceAddr(), "is stopped")
 }
 
 func (ws *webService) Close() error {
 	if ws.watcher != nil {
 		ws.watcher.Close()
 	}
+	if ws.acme != nil {
+		ws.acme.close()
+	}
 
 	if ws.server == nil {
 		return nil
@@ -176,10 +245,18 @@ func (ws *webService) Close() error {
 	// use context to control timeout of http.Server.Shutdown
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
+	if ws.redirectServer != nil {
+		ws.redirectServer.Shutdown(ctx)
+	}
+	if ws.http3Server != nil {
+		ws.http3Server.Shutdown(ctx)
+	}
 	err := ws.server.Shutdown(ctx)
 	if err != nil {
 		ws.Logger.Error("http server shutdown with error", err)
 	}
+	// listeners are closed by Shutdown once they are served, others are closed here
+	ws.closeListeners()
 	return err
 }
 
@@ -205,16 +282,19 @@ func (ws *webService) dispatch(w http.ResponseWriter, r *http.Request) {
 	remoteAddr := remoteAddrOfRequest(r)
 
 	ws.Logger.Trace("service", ws.server.Addr,
-		"get request from", remoteAddr, "path", r.URL.Path, "form", r.Form, "post form", r.PostForm)
+		"get request from", remoteAddr, "proto", r.Proto, "path", r.URL.Path, "form", r.Form, "post form", r.PostForm)
 
-	if r.URL.Path == "/favicon.ico" {
-		faviconHandler.ServeHTTP(w, r)
+	if h, ok := ws.rootFiles[r.URL.Path]; ok {
+		h.ServeHTTP(w, r)
 		ws.Logger.Trace("service", ws.server.Addr,
 			"handled request from", remoteAddr, "path", r.URL.Path)
 		return
 	}
 
-	rsp := ws.checkAuth(r.URL.Path, r.RemoteAddr)
+	// threat others as interface access,
+	// route is resolved first so that AuthMap entries of prefix routes cover their sub-paths
+	route, handler := ws.handerForPath(r.URL.Path)
+	rsp := ws.checkAuth(route, r)
 	if rsp != nil {
 		ws.Logger.Warn("service", ws.server.Addr, "checkAuth for",
 			remoteAddr, "returned", rsp)
@@ -222,8 +302,6 @@ func (ws *webService) dispatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// threat others as interface access
-	handler := ws.handerForPath(r.URL.Path)
 	if handler == nil {
 		ws.jsonResponseWithStatus(w, r, &ServiceResponse{
 			Status:  http.StatusBadRequest,
@@ -235,7 +313,97 @@ func (ws *webService) dispatch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := handler(w, r, ws)
+	// requests are shed before any work is done for them
+	release, rsp := ws.checkConcurrency(route, w, r)
+	if rsp != nil {
+		ws.Logger.Warn("service", ws.server.Addr, "checkConcurrency for",
+			remoteAddr, "returned", rsp)
+		ws.jsonResponseWithStatus(w, r, rsp, rsp.Status)
+		return
+	}
+	// handedOver marks resources of request handed over to handler overrunning its timeout
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			release()
+		}
+	}()
+
+	// limits keyed by ip or api key are checked before body is read for signature
+	if rsp := ws.checkRateLimit(route, w, r, false); rsp != nil {
+		ws.Logger.Warn("service", ws.server.Addr, "checkRateLimit for",
+			remoteAddr, "returned", rsp)
+		ws.jsonResponseWithStatus(w, r, rsp, rsp.Status)
+		return
+	}
+
+	if rsp := ws.checkBodySize(route, r); rsp != nil {
+		ws.Logger.Warn("service", ws.server.Addr, "checkBodySize for",
+			remoteAddr, "returned", rsp)
+		ws.jsonResponseWithStatus(w, r, rsp, rsp.Status)
+		return
+	}
+	// body is kept here, before handler may replace request body
+	body := r.Body.(*requestBody)
+	defer func() {
+		if !handedOver {
+			body.closeBuffered()
+		}
+	}()
+
+	r, rsp = ws.checkClientCert(route, r)
+	if rsp != nil {
+		ws.Logger.Warn("service", ws.server.Addr, "checkClientCert for",
+			remoteAddr, "returned", rsp)
+		ws.jsonResponseWithStatus(w, r, rsp, rsp.Status)
+		return
+	}
+
+	// principal of signature overrides principal of client certificate
+	r, rsp = ws.checkSignature(route, r)
+	if rsp != nil {
+		ws.Logger.Warn("service", ws.server.Addr, "checkSignature for",
+			remoteAddr, "returned", rsp)
+		// rejected requests are counted by limits keyed by principal as anonymous ones
+		if limited := ws.checkRateLimit(route, w, r, true); limited != nil {
+			rsp = limited
+		}
+		ws.jsonResponseWithStatus(w, r, rsp, rsp.Status)
+		return
+	}
+
+	// limits keyed by principal are checked after principal is authenticated
+	if rsp := ws.checkRateLimit(route, w, r, true); rsp != nil {
+		ws.Logger.Warn("service", ws.server.Addr, "checkRateLimit for",
+			remoteAddr, "returned", rsp)
+		ws.jsonResponseWithStatus(w, r, rsp, rsp.Status)
+		return
+	}
+
+	r, rsp = ws.checkCSRF(route, w, r)
+	if rsp != nil {
+		ws.Logger.Warn("service", ws.server.Addr, "checkCSRF for",
+			remoteAddr, "returned", rsp)
+		ws.jsonResponseWithStatus(w, r, rsp, rsp.Status)
+		return
+	}
+
+	w, r, commit := ws.startSession(w, r)
+	resp, running := ws.runHandler(route, handler, w, r)
+	if running != nil {
+		// concurrency slot is kept until handler returns, so that overrunning handlers still count
+		handedOver = true
+		go func() {
+			<-running
+			body.closeBuffered()
+			release()
+		}()
+		ws.Logger.Warn("service", ws.server.Addr, "remote address", remoteAddr,
+			"path", r.URL.Path, "handler timed out and its response is dropped")
+		return
+	}
+	// session must be committed before response header is written
+	commit()
 	if resp != nil {
 		if resp.StatusCode > 0 && resp.StatusCode != 200 {
 			ws.jsonResponseWithStatus(w, r, resp, resp.StatusCode)
@@ -248,20 +416,49 @@ func (ws *webService) dispatch(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (ws *webService) handerForPath(path string) RequestHandlerFunc {
+// checkBodySize rejects request declaring a body larger than limit of route,
+// and limits bytes read from body so that chunked body is limited as well
+func (ws *webService) checkBodySize(route string, r *http.Request) *ServiceResponse {
+	limit := ws.MaxBodySize
+	if v, ok := ws.RouteMaxBodySizes[route]; ok {
+		limit = v
+	}
+
+	if limit > 0 && r.ContentLength > limit {
+		return BodyErrorResponse(ErrorBodyTooLarge)
+	}
+	r.Body = newRequestBody(r.Body, limit)
+	return nil
+}
+
+// handerForPath returns matched route and its handler,
+// route ends with slash except root handles all paths under it and the longest one wins
+func (ws *webService) handerForPath(path string) (string, RequestHandlerFunc) {
 	if v, ok := ws.Handlers[path]; ok {
-		return v
+		return path, v
 	}
 
 	// allows case-insenstitve path
 	for k, v := range ws.Handlers {
 		if strings.EqualFold(path, k) {
-			return v
+			return k, v
+		}
+	}
+
+	route := ""
+	var handler RequestHandlerFunc
+	for k, v := range ws.Handlers {
+		if k != "/" && strings.HasSuffix(k, "/") && len(k) > len(route) &&
+			len(path) > len(k) && strings.EqualFold(path[:len(k)], k) {
+			route, handler = k, v
 		}
 	}
+	if handler != nil {
+		return route, handler
+	}
 
 	ws.Logger.Warn("service", ws.server.Addr, "not found handler for", path)
-	return nil
+	return "", nil
 }
 
 func jsonResponse(w http.ResponseWriter, r *http.Request, data *ServiceResponse, host string, logger Logger) {
@@ -311,9 +508,15 @@ func (ws webService) jsonResponse(w http.ResponseWriter, r *http.Request, data *
 }
 
 func (ws webService) jsonResponseWithStatus(w http.ResponseWriter, r *http.Request, data *ServiceResponse, status int) {
+	jsonResponseWithStatus(w, r, data, status, ws.server.Addr, ws.Logger)
+}
+
+func jsonResponseWithStatus(w http.ResponseWriter, r *http.Request, data *ServiceResponse, status int, host string, logger Logger) {
 	remoteAddr := remoteAddrOfRequest(r)
-	ws.Logger.Trace("service", ws.server.Addr,
+	logger.Trace("service", host,
 		"response request from", remoteAddr, "path", r.RequestURI, "with status", status)
+	// headers must be set before status is written
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	w.WriteHeader(status)
-	ws.jsonResponse(w, r, data)
+	jsonResponse(w, r, data, host, logger)
 }
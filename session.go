@@ -0,0 +1,636 @@
+package webservice
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCookieSize is the size browsers are guaranteed to keep for a cookie
+const maxCookieSize = 4096
+
+// SessionConfig stores session config
+type SessionConfig struct {
+	CookieName     string
+	CookiePath     string
+	CookieDomain   string
+	CookieSecure   bool
+	CookieSameSite http.SameSite
+	// HashKey signs session cookies, it is required
+	HashKey []byte
+	// BlockKey encrypts cookie sessions with aes-gcm if it is 16, 24 or 32 bytes
+	BlockKey []byte
+	// IdleTimeout expires sessions not accessed for the duration
+	IdleTimeout time.Duration
+	// AbsoluteTimeout expires sessions created for the duration, however they are accessed
+	AbsoluteTimeout time.Duration
+	// Store keeps sessions on server and cookies keep only session ids,
+	// whole session is kept in cookie if it is nil
+	Store  SessionStore
+	Logger Logger
+}
+
+// BuildSessionConfig builds a default cookie session config signed by hash key
+func BuildSessionConfig(hashKey []byte) *SessionConfig {
+	return &SessionConfig{
+		CookieName:      "session",
+		CookiePath:      "/",
+		CookieSameSite:  http.SameSiteLaxMode,
+		HashKey:         hashKey,
+		IdleTimeout:     30 * time.Minute,
+		AbsoluteTimeout: 24 * time.Hour,
+		Logger:          &logger{},
+	}
+}
+
+// SessionData stores values of session kept in cookie or store, values are json encoded
+type SessionData struct {
+	Values     map[string]interface{} `json:"values,omitempty"`
+	Flashes    []string               `json:"flashes,omitempty"`
+	CreatedAt  time.Time              `json:"created"`
+	AccessedAt time.Time              `json:"accessed"`
+}
+
+// SessionStore defines server side storage interface of sessions
+type SessionStore interface {
+	// Load returns data of session id, nil data is returned if session does not exist
+	Load(id string) (*SessionData, error)
+	Save(id string, data *SessionData, ttl time.Duration) error
+	Delete(id string) error
+}
+
+// Session stores values of a client across requests
+type Session struct {
+	lock      sync.Mutex
+	id        string
+	oldID     string
+	data      SessionData
+	destroyed bool
+	// committed marks session saved before response is written, later changes are not saved
+	committed bool
+	logger    Logger
+}
+
+func newSession() (*Session, error) {
+	id, err := randomName("")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &Session{id: id, data: SessionData{CreatedAt: now, AccessedAt: now}}, nil
+}
+
+// ID returns session id, it changes after Rotate
+func (s *Session) ID() string {
+	if s == nil {
+		return ""
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.id
+}
+
+// Get returns value of key, values kept in cookie or store are json decoded
+func (s *Session) Get(key string) interface{} {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.data.Values[key]
+}
+
+// Set sets value of key, value must be able to be json encoded
+func (s *Session) Set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.warnCommitted("set", key)
+	if s.data.Values == nil {
+		s.data.Values = make(map[string]interface{})
+	}
+	s.data.Values[key] = value
+}
+
+// Delete removes value of key
+func (s *Session) Delete(key string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.warnCommitted("delete", key)
+	delete(s.data.Values, key)
+}
+
+// AddFlash adds a message shown once by the next Flashes
+func (s *Session) AddFlash(message string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.warnCommitted("add flash")
+	s.data.Flashes = append(s.data.Flashes, message)
+}
+
+// Flashes returns and removes flash messages
+func (s *Session) Flashes() []string {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.data.Flashes) > 0 {
+		s.warnCommitted("read flashes")
+	}
+	flashes := s.data.Flashes
+	s.data.Flashes = nil
+	return flashes
+}
+
+// Rotate changes session id and keeps values, it should be called on login to prevent fixation.
+// Creation time is kept as well, so rotating never extends absolute timeout of session
+func (s *Session) Rotate() error {
+	if s == nil {
+		return ErrorSessionDisabled
+	}
+	id, err := randomName("")
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.warnCommitted("rotate")
+	if s.oldID == "" {
+		s.oldID = s.id
+	}
+	s.id = id
+	return nil
+}
+
+// Destroy removes session and its cookie
+func (s *Session) Destroy() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.warnCommitted("destroy")
+	s.destroyed = true
+	s.data.Values = nil
+	s.data.Flashes = nil
+}
+
+// warnCommitted logs change of session which has been committed, it must be called with lock held
+func (s *Session) warnCommitted(args ...interface{}) {
+	if s.committed && s.logger != nil {
+		s.logger.Warn(append([]interface{}{"session", s.id, "is changed after response is written, change is not saved:"},
+			args...)...)
+	}
+}
+
+// SessionFromRequest returns session of request, session is loaded at first access and is saved
+// before response is written. It is nil if sessions are disabled.
+func SessionFromRequest(r *http.Request) *Session {
+	return requestStateFromRequest(r).sessionOf()
+}
+
+// sessionHolder loads session of request lazily, session accessed after commit is not saved
+type sessionHolder struct {
+	lock      sync.Mutex
+	mgr       *sessionManager
+	r         *http.Request
+	session   *Session
+	committed bool
+}
+
+func (h *sessionHolder) get() *Session {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.session == nil {
+		h.session = h.mgr.load(h.r)
+		if h.session != nil {
+			h.session.logger = h.mgr.logger
+			h.session.committed = h.committed
+		}
+	}
+	return h.session
+}
+
+// commit marks response started and returns session if it has been accessed
+func (h *sessionHolder) commit() *Session {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.committed = true
+	return h.session
+}
+
+type sessionManager struct {
+	SessionConfig
+	aead   cipher.AEAD
+	logger Logger
+}
+
+func buildSessionManager(conf *SessionConfig, log Logger) (*sessionManager, error) {
+	if conf == nil || len(conf.HashKey) == 0 || strings.TrimSpace(conf.CookieName) == "" {
+		return nil, ErrorInvalidArgument
+	}
+
+	mgr := &sessionManager{SessionConfig: *conf, logger: ConvertLoggerMust(log)}
+	if conf.Logger != nil {
+		mgr.logger = conf.Logger
+	}
+	if len(conf.BlockKey) > 0 {
+		block, err := aes.NewCipher(conf.BlockKey)
+		if err != nil {
+			return nil, err
+		}
+		if mgr.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return mgr, nil
+}
+
+// load reads session of request, a new session is created if it does not exist or is expired
+func (mgr *sessionManager) load(r *http.Request) *Session {
+	if cookie, err := r.Cookie(mgr.CookieName); err == nil {
+		if s := mgr.decode(cookie.Value); s != nil && !mgr.expired(&s.data) {
+			s.data.AccessedAt = time.Now()
+			return s
+		}
+	}
+
+	s, err := newSession()
+	if err != nil {
+		mgr.logger.Error("create session failed with", err)
+		return nil
+	}
+	return s
+}
+
+func (mgr *sessionManager) expired(data *SessionData) bool {
+	now := time.Now()
+	if mgr.IdleTimeout > 0 && now.Sub(data.AccessedAt) > mgr.IdleTimeout {
+		return true
+	}
+	return mgr.AbsoluteTimeout > 0 && now.Sub(data.CreatedAt) > mgr.AbsoluteTimeout
+}
+
+// ttl returns remaining lifetime of session
+func (mgr *sessionManager) ttl(data *SessionData) time.Duration {
+	ttl := mgr.IdleTimeout
+	if mgr.AbsoluteTimeout > 0 {
+		if remaining := time.Until(data.CreatedAt.Add(mgr.AbsoluteTimeout)); ttl <= 0 || remaining < ttl {
+			ttl = remaining
+		}
+	}
+	return ttl
+}
+
+// decode verifies cookie value and loads its session
+func (mgr *sessionManager) decode(value string) *Session {
+	payload, ok := mgr.verify(value)
+	if !ok {
+		return nil
+	}
+
+	if mgr.Store != nil {
+		id := string(payload)
+		data, err := mgr.Store.Load(id)
+		if err != nil {
+			mgr.logger.Warn("load session", id, "failed with", err)
+			return nil
+		}
+		if data == nil {
+			return nil
+		}
+		return &Session{id: id, data: *data}
+	}
+
+	if mgr.aead != nil {
+		size := mgr.aead.NonceSize()
+		if len(payload) < size {
+			return nil
+		}
+		var err error
+		if payload, err = mgr.aead.Open(nil, payload[:size], payload[size:], []byte(mgr.CookieName)); err != nil {
+			return nil
+		}
+	}
+	s := &Session{}
+	var cookie struct {
+		ID string `json:"id"`
+		SessionData
+	}
+	if err := json.Unmarshal(payload, &cookie); err != nil {
+		return nil
+	}
+	s.id, s.data = cookie.ID, cookie.SessionData
+	return s
+}
+
+// commit saves session and sets its cookie, it must be called before response header is written
+func (mgr *sessionManager) commit(w http.ResponseWriter, s *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.committed = true
+
+	if s.destroyed {
+		if mgr.Store != nil {
+			mgr.deleteFromStore(s.id)
+			mgr.deleteFromStore(s.oldID)
+		}
+		mgr.setCookie(w, "", -1)
+		return
+	}
+
+	ttl := mgr.ttl(&s.data)
+	var payload []byte
+	if mgr.Store != nil {
+		storeTTL := ttl
+		if storeTTL <= 0 {
+			// sessions without timeouts last as long as browser keeps cookie, keep them for a day
+			storeTTL = 24 * time.Hour
+		}
+		mgr.deleteFromStore(s.oldID)
+		if err := mgr.Store.Save(s.id, &s.data, storeTTL); err != nil {
+			mgr.logger.Error("save session", s.id, "failed with", err)
+			return
+		}
+		payload = []byte(s.id)
+	} else {
+		var err error
+		payload, err = json.Marshal(struct {
+			ID string `json:"id"`
+			SessionData
+		}{s.id, s.data})
+		if err != nil {
+			mgr.logger.Error("encode session failed with", err)
+			return
+		}
+		if mgr.aead != nil {
+			nonce := make([]byte, mgr.aead.NonceSize())
+			if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+				mgr.logger.Error("generate session nonce failed with", err)
+				return
+			}
+			payload = mgr.aead.Seal(nonce, nonce, payload, []byte(mgr.CookieName))
+		}
+	}
+	s.oldID = ""
+
+	value := mgr.sign(payload)
+	if len(value) > maxCookieSize {
+		mgr.logger.Error("session cookie of", len(value), "bytes is too large to be kept by browsers")
+		return
+	}
+	// zero max age makes a browser session cookie
+	maxAge := int(ttl / time.Second)
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	mgr.setCookie(w, value, maxAge)
+}
+
+func (mgr *sessionManager) deleteFromStore(id string) {
+	if id == "" {
+		return
+	}
+	if err := mgr.Store.Delete(id); err != nil {
+		mgr.logger.Warn("delete session", id, "failed with", err)
+	}
+}
+
+func (mgr *sessionManager) setCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     mgr.CookieName,
+		Value:    value,
+		Path:     mgr.CookiePath,
+		Domain:   mgr.CookieDomain,
+		MaxAge:   maxAge,
+		Secure:   mgr.CookieSecure,
+		HttpOnly: true,
+		SameSite: mgr.CookieSameSite,
+	})
+}
+
+// sign encodes payload with its hmac which also covers cookie name
+func (mgr *sessionManager) sign(payload []byte) string {
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mgr.mac(encoded))
+}
+
+func (mgr *sessionManager) verify(value string) ([]byte, bool) {
+	i := strings.LastIndex(value, ".")
+	if i <= 0 {
+		return nil, false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !hmac.Equal(mac, mgr.mac(value[:i])) {
+		return nil, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(value[:i])
+	return payload, err == nil
+}
+
+func (mgr *sessionManager) mac(encoded string) []byte {
+	h := hmac.New(sha256.New, mgr.HashKey)
+	h.Write([]byte(mgr.CookieName + "|" + encoded))
+	return h.Sum(nil)
+}
+
+// startSession makes session of request available to handler and templates,
+// the session accessed by handler is committed before response is written or by the returned function
+func (ws *webService) startSession(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	mgr := ws.sessions
+	if mgr == nil {
+		return w, r, func() {}
+	}
+
+	state := requestStateFromRequest(r)
+	if state == nil {
+		state = &requestState{}
+		r = r.WithContext(context.WithValue(r.Context(), contextKeyRequestState, state))
+	}
+	holder := &sessionHolder{mgr: mgr, r: r}
+	state.session = holder
+
+	sw := &stateWriter{ResponseWriter: w, state: state}
+	sw.before = func() {
+		if s := holder.commit(); s != nil {
+			mgr.commit(w, s)
+		}
+	}
+	return sw, r, sw.writeBefore
+}
+
+// memorySessionStore stores sessions in memory, expired sessions are swept while saving
+type memorySessionStore struct {
+	lock      sync.Mutex
+	sessions  map[string]memorySessionEntry
+	lastSweep time.Time
+}
+
+type memorySessionEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// BuildMemorySessionStore builds a session store keeping sessions in memory
+func BuildMemorySessionStore() SessionStore {
+	return &memorySessionStore{sessions: make(map[string]memorySessionEntry, 1024), lastSweep: time.Now()}
+}
+
+func (s *memorySessionStore) Load(id string) (*SessionData, error) {
+	s.lock.Lock()
+	entry, ok := s.sessions[id]
+	s.lock.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		return nil, nil
+	}
+
+	// sessions are kept encoded so that loaded sessions do not share values
+	data := &SessionData{}
+	if err := json.Unmarshal(entry.data, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *memorySessionStore) Save(id string, data *SessionData, ttl time.Duration) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, entry := range s.sessions {
+			if now.After(entry.expires) {
+				delete(s.sessions, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.sessions[id] = memorySessionEntry{data: encoded, expires: now.Add(ttl)}
+	return nil
+}
+
+func (s *memorySessionStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// fileSessionStore stores each session in a json file named by its id
+type fileSessionStore struct {
+	dir string
+}
+
+type fileSessionEntry struct {
+	Expires time.Time    `json:"expires"`
+	Data    *SessionData `json:"data"`
+}
+
+// BuildFileSessionStore builds a session store keeping sessions in files of dir
+func BuildFileSessionStore(dir string) (SessionStore, error) {
+	if strings.TrimSpace(dir) == "" {
+		return nil, ErrorInvalidArgument
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileSessionStore{dir: dir}, nil
+}
+
+func (s *fileSessionStore) path(id string) (string, error) {
+	// session ids are generated hex strings, others may be path traversal
+	if !randomIDPattern.MatchString(id) {
+		return "", ErrorInvalidArgument
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+func (s *fileSessionStore) Load(id string) (*SessionData, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &fileSessionEntry{}
+	if err := json.Unmarshal(content, entry); err != nil {
+		return nil, err
+	}
+	if time.Now().After(entry.Expires) {
+		os.Remove(path)
+		return nil, nil
+	}
+	return entry.Data, nil
+}
+
+func (s *fileSessionStore) Save(id string, data *SessionData, ttl time.Duration) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(&fileSessionEntry{Expires: time.Now().Add(ttl), Data: data})
+	if err != nil {
+		return err
+	}
+
+	// write to temporary file and rename so that readers never see partial session,
+	// each save has its own temporary file since the same session can be saved concurrently
+	tmp, err := os.CreateTemp(s.dir, id+".json.tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *fileSessionStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
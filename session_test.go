@@ -0,0 +1,177 @@
+package webservice
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatchSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileStore, err := BuildFileSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, store := range []SessionStore{nil, BuildMemorySessionStore(), fileStore} {
+		var ids []string
+		ws := buildTestService(map[string]RequestHandlerFunc{
+			"/login": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+				s := SessionFromRequest(r)
+				ids = append(ids, s.ID())
+				s.Rotate()
+				s.Set("user", "alice")
+				s.AddFlash("welcome")
+				ids = append(ids, s.ID())
+				return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+			},
+			"/home": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+				s := SessionFromRequest(r)
+				return &ServiceResponse{Status: ErrorCodeSuccess, Message: s.Get("user"), Data: s.Flashes()}
+			},
+			"/logout": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+				SessionFromRequest(r).Destroy()
+				return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+			},
+		})
+		ws.Sessions = BuildSessionConfig([]byte("hash key"))
+		ws.Sessions.BlockKey = []byte("0123456789abcdef")
+		ws.Sessions.Store = store
+		ws.Sessions.Logger = ws.Logger
+		ws.initRequestLayers()
+
+		cookies := []*http.Cookie{}
+		do := func(path string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", path, nil)
+			r.RemoteAddr = "127.0.0.1:1234"
+			for _, c := range cookies {
+				r.AddCookie(c)
+			}
+			w := httptest.NewRecorder()
+			ws.dispatch(w, r)
+			if set := w.Result().Cookies(); len(set) > 0 {
+				cookies = set
+			}
+			return w
+		}
+
+		do("/login")
+		if len(ids) != 2 || ids[0] == ids[1] || len(cookies) != 1 {
+			t.Fatalf("session is not rotated or committed, ids %v cookies %v", ids, cookies)
+		}
+		if body := do("/home").Body.String(); body != `{"status":1,"message":"alice","data":["welcome"]}` {
+			t.Fatalf("unexpected session values %v with store %T", body, store)
+		}
+		if body := do("/home").Body.String(); body != `{"status":1,"message":"alice","data":null}` {
+			t.Fatalf("flash is shown twice %v with store %T", body, store)
+		}
+		do("/logout")
+		if cookies[0].MaxAge >= 0 {
+			t.Fatalf("session cookie is not removed, got %v", cookies[0])
+		}
+	}
+}
+
+func TestTemplateFlashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "page.html"),
+		[]byte(`<p>messages</p>{{range flashes}}<p>{{.}}</p>{{end}}`), 0600)
+
+	ws := buildTestService(map[string]RequestHandlerFunc{
+		"/post": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			SessionFromRequest(r).AddFlash("hi")
+			return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+		},
+		"/page": func(w http.ResponseWriter, r *http.Request, s WebService) *ServiceResponse {
+			if err := s.TemplatesManager().RenderTemplate(w, "page.html", nil); err != nil {
+				t.Fatal(err)
+			}
+			return nil
+		},
+	})
+	ws.templatesManager = buildTemplatesManager(dir, "*.html", "", "", ws.Logger)
+	ws.Sessions = BuildSessionConfig([]byte("hash key"))
+	ws.Sessions.Logger = ws.Logger
+	ws.initRequestLayers()
+
+	cookies := []*http.Cookie{}
+	do := func(path string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		ws.dispatch(w, r)
+		if set := w.Result().Cookies(); len(set) > 0 {
+			cookies = set
+		}
+		return w.Body.String()
+	}
+
+	do("/post")
+	if body := do("/page"); body != "<p>messages</p><p>hi</p>" {
+		t.Fatal("unexpected page", body)
+	}
+	if body := do("/page"); body != "<p>messages</p>" {
+		t.Fatal("flash is shown twice", body)
+	}
+
+	var s *Session
+	s.Set("user", "alice")
+	s.AddFlash("hi")
+	s.Destroy()
+	if s.Rotate() != ErrorSessionDisabled {
+		t.Fatal("nil session is rotated")
+	}
+}
+
+func TestSessionRotateAndConcurrentSaves(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	s := &Session{id: "old", data: SessionData{CreatedAt: created}}
+	if err := s.Rotate(); err != nil || s.ID() == "old" || !s.data.CreatedAt.Equal(created) {
+		t.Fatalf("rotated session %v has created time %v", s.ID(), s.data.CreatedAt)
+	}
+
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := BuildFileSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := randomName("")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := &SessionData{Values: map[string]interface{}{"n": strings.Repeat("x", i*100)}}
+			if err := store.Save(id, data, time.Minute); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if data, err := store.Load(id); err != nil || data == nil {
+		t.Fatal("session saved concurrently is corrupted", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("temporary files are left, got %v files", len(files))
+	}
+}
@@ -0,0 +1,263 @@
+package webservice
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SignatureConfig stores request signature verification config
+type SignatureConfig struct {
+	// Keys maps key ids to shared secrets
+	Keys map[string][]byte
+	// Algorithm is digest algorithm of body hash and hmac signature
+	Algorithm       string
+	KeyIDHeader     string
+	SignatureHeader string
+	TimestampHeader string
+	NonceHeader     string
+	// SignedHeaders lists headers included in signature, Host is taken from request host
+	SignedHeaders []string
+	// MaxSkew rejects timestamps older or newer than the duration
+	MaxSkew time.Duration
+	// NonceStore rejects replayed nonces, nonce is not required if it is nil
+	NonceStore NonceStore
+	// Body limits body read for hashing
+	Body   *BodyConfig
+	Logger Logger
+}
+
+// BuildSignatureConfig builds a default signature config with keys
+func BuildSignatureConfig(keys map[string][]byte) *SignatureConfig {
+	return &SignatureConfig{
+		Keys:            keys,
+		Algorithm:       DigestSHA256,
+		KeyIDHeader:     "X-Key-Id",
+		SignatureHeader: "X-Signature",
+		TimestampHeader: "X-Timestamp",
+		NonceHeader:     "X-Nonce",
+		SignedHeaders:   []string{"Host", "Content-Type"},
+		MaxSkew:         5 * time.Minute,
+		NonceStore:      BuildMemoryNonceStore(),
+		Body:            BuildBodyConfig(),
+		Logger:          &logger{},
+	}
+}
+
+// SignatureVerifier defines hmac request signature interface
+type SignatureVerifier interface {
+	// Verify checks signature of request and returns principal of its key id
+	Verify(r *http.Request) (*Principal, error)
+	// Sign sets timestamp, nonce and signature headers of request with key of key id
+	Sign(r *http.Request, keyID string) error
+}
+
+// NonceStore defines storage interface of used nonces
+type NonceStore interface {
+	// Add stores nonce for ttl, it returns false if nonce is stored already
+	Add(nonce string, ttl time.Duration) (bool, error)
+}
+
+// BuildSignatureVerifier builds signature verifier object with config
+func BuildSignatureVerifier(conf *SignatureConfig) (SignatureVerifier, error) {
+	if conf == nil || len(conf.Keys) == 0 || strings.TrimSpace(conf.SignatureHeader) == "" {
+		return nil, ErrorInvalidArgument
+	}
+	if _, err := newDigest(conf.Algorithm, nil); err != nil {
+		return nil, err
+	}
+
+	return &signatureVerifier{
+		SignatureConfig: *conf,
+		logger:          ConvertLoggerMust(conf.Logger),
+	}, nil
+}
+
+type signatureVerifier struct {
+	SignatureConfig
+	logger Logger
+}
+
+func (sv *signatureVerifier) Verify(r *http.Request) (principal *Principal, err error) {
+	sv.logger.Debug("entered...")
+	defer func() { sv.logger.Debug("done with error", err) }()
+
+	keyID := sv.header(r, sv.KeyIDHeader)
+	key, ok := sv.Keys[keyID]
+	if !ok {
+		return nil, ErrorUnknownKey
+	}
+
+	timestamp := sv.header(r, sv.TimestampHeader)
+	if sv.MaxSkew > 0 {
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return nil, ErrorStaleTimestamp
+		}
+		skew := time.Since(time.Unix(seconds, 0))
+		if skew > sv.MaxSkew || skew < -sv.MaxSkew {
+			return nil, ErrorStaleTimestamp
+		}
+	}
+
+	signature := decodeSignature(sv.header(r, sv.SignatureHeader))
+	if signature == nil {
+		return nil, ErrorInvalidSignature
+	}
+	expected, err := sv.signature(r, key, timestamp, sv.header(r, sv.NonceHeader))
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(signature, expected) {
+		return nil, ErrorInvalidSignature
+	}
+
+	// nonce is stored after signature is verified so that forged requests can not burn it
+	if sv.NonceStore != nil {
+		nonce := sv.header(r, sv.NonceHeader)
+		if nonce == "" {
+			return nil, ErrorReplayedNonce
+		}
+		fresh, err := sv.NonceStore.Add(keyID+"\n"+nonce, sv.nonceTTL())
+		if err != nil {
+			return nil, err
+		}
+		if !fresh {
+			return nil, ErrorReplayedNonce
+		}
+	}
+
+	return &Principal{ID: keyID, Scheme: PrincipalSchemeSignature}, nil
+}
+
+func (sv *signatureVerifier) Sign(r *http.Request, keyID string) error {
+	key, ok := sv.Keys[keyID]
+	if !ok {
+		return ErrorUnknownKey
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce, err := randomName("")
+	if err != nil {
+		return err
+	}
+	signature, err := sv.signature(r, key, timestamp, nonce)
+	if err != nil {
+		return err
+	}
+
+	if sv.KeyIDHeader != "" {
+		r.Header.Set(sv.KeyIDHeader, keyID)
+	}
+	if sv.TimestampHeader != "" {
+		r.Header.Set(sv.TimestampHeader, timestamp)
+	}
+	if sv.NonceHeader != "" {
+		r.Header.Set(sv.NonceHeader, nonce)
+	}
+	r.Header.Set(sv.SignatureHeader, hex.EncodeToString(signature))
+	return nil
+}
+
+// nonceTTL keeps nonces while their timestamps are acceptable
+func (sv *signatureVerifier) nonceTTL() time.Duration {
+	if sv.MaxSkew <= 0 {
+		return 24 * time.Hour
+	}
+	return 2 * sv.MaxSkew
+}
+
+func (sv *signatureVerifier) header(r *http.Request, name string) string {
+	if name == "" {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(name))
+}
+
+// signature computes hmac of canonical request, canonical request consists of lines of
+// method, escaped path, sorted query, signed headers, timestamp, nonce and hex body hash
+func (sv *signatureVerifier) signature(r *http.Request, key []byte, timestamp, nonce string) ([]byte, error) {
+	bodyHash, err := sv.bodyHash(r)
+	if err != nil {
+		return nil, err
+	}
+
+	canonical := &bytes.Buffer{}
+	canonical.WriteString(strings.ToUpper(r.Method) + "\n")
+	canonical.WriteString(r.URL.EscapedPath() + "\n")
+	canonical.WriteString(r.URL.Query().Encode() + "\n")
+	for _, name := range sv.SignedHeaders {
+		value := strings.Join(r.Header[textproto.CanonicalMIMEHeaderKey(name)], ",")
+		if strings.EqualFold(name, "Host") {
+			value = r.Host
+		}
+		canonical.WriteString(strings.ToLower(name) + ":" + strings.TrimSpace(value) + "\n")
+	}
+	canonical.WriteString(timestamp + "\n")
+	canonical.WriteString(nonce + "\n")
+	canonical.WriteString(bodyHash)
+
+	h, err := newDigest(sv.Algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(canonical.Bytes())
+	return h.Sum(nil), nil
+}
+
+// bodyHash hashes request body, body is buffered so that handler can read it again
+func (sv *signatureVerifier) bodyHash(r *http.Request) (string, error) {
+	h, err := newDigest(sv.Algorithm, nil)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := readBodyInMemory(r, sv.Body, sv.logger)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, body.Reader()); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// memoryNonceStore stores nonces in memory, expired nonces are swept while adding
+type memoryNonceStore struct {
+	lock      sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+// BuildMemoryNonceStore builds a nonce store keeping nonces in memory
+func BuildMemoryNonceStore() NonceStore {
+	return &memoryNonceStore{nonces: make(map[string]time.Time, 1024), lastSweep: time.Now()}
+}
+
+func (s *memoryNonceStore) Add(nonce string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, expires := range s.nonces {
+			if now.After(expires) {
+				delete(s.nonces, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if expires, ok := s.nonces[nonce]; ok && now.Before(expires) {
+		return false, nil
+	}
+	s.nonces[nonce] = now.Add(ttl)
+	return true, nil
+}
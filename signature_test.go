@@ -0,0 +1,71 @@
+package webservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignatureVerifier(t *testing.T) {
+	conf := BuildSignatureConfig(map[string][]byte{"partner": []byte("secret")})
+	conf.Logger = &logger{level: logLevelError}
+	verifier, err := BuildSignatureVerifier(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var principal *Principal
+	var body []byte
+	handler := func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+		principal = PrincipalFromRequest(r)
+		body, _ = GetDataBody(r, &logger{level: logLevelError})
+		return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+	}
+	ws := buildTestService(map[string]RequestHandlerFunc{"/orders": handler})
+	ws.RouteSignatures = map[string]SignatureVerifier{"/orders": verifier}
+
+	signed := func() *http.Request {
+		r := httptest.NewRequest("POST", "/orders?b=2&a=1", strings.NewReader(`{"id":1}`))
+		r.RemoteAddr = "127.0.0.1:1234"
+		r.Header.Set("Content-Type", "application/json")
+		if err := verifier.Sign(r, "partner"); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	do := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		ws.dispatch(w, r)
+		return w.Code
+	}
+
+	r := signed()
+	if code := do(r); code != http.StatusOK {
+		t.Fatalf("signed request is rejected with %v", code)
+	}
+	if principal == nil || principal.ID != "partner" || string(body) != `{"id":1}` {
+		t.Fatalf("unexpected principal %+v and body %q", principal, body)
+	}
+
+	replayed := httptest.NewRequest("POST", "/orders?b=2&a=1", strings.NewReader(`{"id":1}`))
+	replayed.RemoteAddr = r.RemoteAddr
+	replayed.Header = r.Header
+	if code := do(replayed); code != http.StatusUnauthorized {
+		t.Fatalf("expected replayed request to be rejected, got %v", code)
+	}
+
+	r = signed()
+	r.URL.RawQuery = "a=1&b=3"
+	if code := do(r); code != http.StatusUnauthorized {
+		t.Fatalf("expected tampered request to be rejected, got %v", code)
+	}
+
+	r = signed()
+	r.Header.Set("X-Timestamp", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	if _, err := verifier.Verify(r); err != ErrorStaleTimestamp {
+		t.Fatalf("expected stale timestamp error, got %v", err)
+	}
+}
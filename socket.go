@@ -0,0 +1,180 @@
+package webservice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// ListenerNetworkUnix listens on unix domain socket of Addr
+	ListenerNetworkUnix = "unix"
+	// ListenerNetworkSystemd takes listeners passed by systemd socket activation,
+	// Addr selects them by FileDescriptorName of socket unit, all of them are taken if it is empty
+	ListenerNetworkSystemd = "systemd"
+
+	// systemdListenFDsStart is the first file descriptor passed by systemd
+	systemdListenFDsStart = 3
+)
+
+// systemdFile is a file descriptor passed by systemd
+type systemdFile struct {
+	file  *os.File
+	name  string
+	taken bool
+}
+
+var (
+	systemdOnce  sync.Once
+	systemdLock  sync.Mutex
+	systemdFiles []*systemdFile
+)
+
+// listenFDs reads file descriptors passed by systemd from LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES,
+// variables are unset so that child processes don't take them
+func listenFDs(start int) []*systemdFile {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	files := make([]*systemdFile, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(start+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, &systemdFile{file: os.NewFile(uintptr(start+i), name), name: name})
+	}
+	return files
+}
+
+// systemdListeners takes listeners passed by systemd of name, or all remaining ones if name is empty
+func systemdListeners(name string) ([]net.Listener, error) {
+	systemdOnce.Do(func() {
+		systemdFiles = listenFDs(systemdListenFDsStart)
+	})
+	systemdLock.Lock()
+	defer systemdLock.Unlock()
+
+	var listeners []net.Listener
+	for _, f := range systemdFiles {
+		if f.taken || (name != "" && f.name != name) {
+			continue
+		}
+		// listener holds a duplicate of descriptor, so the passed one is closed
+		l, err := net.FileListener(f.file)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("systemd listener %v: %v", f.name, err)
+		}
+		f.file.Close()
+		f.taken = true
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no systemd listener %q is passed", name)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on unix domain socket of conf, stale socket of exited process is removed first,
+// mode and owner of socket are set if they are configured
+func listenUnix(conf ListenerConfig) (net.Listener, error) {
+	if err := removeStaleSocket(conf.Addr); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen(ListenerNetworkUnix, conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.SocketMode != 0 {
+		if err := os.Chmod(conf.Addr, conf.SocketMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if conf.SocketOwner != "" || conf.SocketGroup != "" {
+		uid, gid, err := lookupOwner(conf.SocketOwner, conf.SocketGroup)
+		if err == nil {
+			err = os.Chown(conf.Addr, uid, gid)
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes socket file which no process listens on,
+// other files and sockets in use are kept and reported
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout(ListenerNetworkUnix, path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %v is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// lookupOwner resolves user and group names or ids, -1 keeps the current one
+func lookupOwner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			if u, err = user.LookupId(owner); err != nil {
+				return 0, 0, err
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, err
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return 0, 0, err
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, err
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,123 @@
+//go:build !windows
+
+package webservice
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestUnixListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "web.sock")
+
+	// socket file left by a crashed process
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	conf := BuildConfig()
+	conf.Logger = &logger{level: logLevelError}
+	conf.Pprof = false
+	conf.Listeners = []ListenerConfig{{
+		Network:     ListenerNetworkUnix,
+		Addr:        path,
+		SocketMode:  0660,
+		SocketGroup: strconv.Itoa(os.Getgid()),
+	}}
+	conf.Handlers = map[string]RequestHandlerFunc{
+		"/ping": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+		},
+	}
+	ws := StartWebService(conf)
+	defer ws.Close()
+
+	if addrs := ws.ServiceAddrs(); len(addrs) != 1 || addrs[0] != path {
+		t.Fatal("unexpected service addresses", addrs)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0660 {
+		t.Fatal("unexpected socket mode", info, err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	rsp, err := client.Get("http://unix/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatal("unexpected status", rsp.StatusCode)
+	}
+
+	// sockets in use and other files are never removed
+	if _, err := listenUnix(ListenerConfig{Addr: path}); err == nil {
+		t.Fatal("socket in use is replaced")
+	}
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, nil, 0600)
+	if _, err := listenUnix(ListenerConfig{Addr: file}); err == nil {
+		t.Fatal("regular file is replaced")
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// passed descriptor is owned by nobody like the ones passed by systemd
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer l.Close()
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "web")
+	files := listenFDs(fd)
+	if len(files) != 1 || files[0].name != "web" || os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("unexpected passed files", files)
+	}
+	systemdOnce.Do(func() { systemdFiles = files })
+
+	if _, err := systemdListeners("api"); err == nil {
+		t.Fatal("expected error of unknown name")
+	}
+	listeners, err := systemdListeners("web")
+	if err != nil || len(listeners) != 1 {
+		t.Fatal("unexpected systemd listeners", listeners, err)
+	}
+	defer listeners[0].Close()
+	if listeners[0].Addr().String() != l.Addr().String() {
+		t.Fatal("unexpected listener address", listeners[0].Addr())
+	}
+	if _, err := systemdListeners(""); err == nil {
+		t.Fatal("listener is taken twice")
+	}
+}
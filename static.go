@@ -0,0 +1,270 @@
+package webservice
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// CacheControlRule sets Cache-Control of static files matching Pattern
+type CacheControlRule struct {
+	// Pattern is matched by path.Match against file path and its base name, such as "*.js" or "/assets/*"
+	Pattern string
+	Value   string
+}
+
+// StaticConfig stores static file handler config
+type StaticConfig struct {
+	// Root is directory of files, FS is served instead if it is set, such as embed.FS
+	Root string
+	FS   fs.FS
+	// Index is served for directories
+	Index string
+	// Listing lists directories without index
+	Listing bool
+	// CacheControl rules are matched in order, the first matching one is used
+	CacheControl []CacheControlRule
+	// Precompressed serves .br and .gz siblings of files to clients accepting them
+	Precompressed bool
+	// Fallback is served for unknown paths without extension, such as index.html of single page apps
+	Fallback string
+	// Dotfiles serves files and directories whose names start with dot
+	Dotfiles bool
+	Logger   Logger
+}
+
+// BuildStaticConfig builds a default static config of directory
+func BuildStaticConfig(root string) *StaticConfig {
+	return &StaticConfig{
+		Root:  root,
+		Index: "index.html",
+		CacheControl: []CacheControlRule{
+			{Pattern: "*.html", Value: "no-cache"},
+		},
+		Precompressed: true,
+		Logger:        &logger{},
+	}
+}
+
+// staticHandler serves files of file system
+type staticHandler struct {
+	StaticConfig
+	fsys   fs.FS
+	logger Logger
+	// etags caches strong etags keyed by file path, modification time and size
+	etags sync.Map
+}
+
+// BuildStaticHandler builds handler serving static files, it should be mounted by http.StripPrefix
+func BuildStaticHandler(conf *StaticConfig) http.Handler {
+	h := &staticHandler{StaticConfig: *conf, fsys: conf.FS, logger: ConvertLoggerMust(conf.Logger)}
+	if h.fsys == nil {
+		h.fsys = os.DirFS(conf.Root)
+	}
+	return h
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upath := path.Clean("/" + r.URL.Path)
+	if !h.Dotfiles && hasDotSegment(upath) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(upath, "/")
+	if name == "" {
+		name = "."
+	}
+
+	info, err := fs.Stat(h.fsys, name)
+	if err == nil && info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") && name != "." {
+			// relative links of index need trailing slash
+			localRedirect(w, r, path.Base(r.URL.Path)+"/")
+			return
+		}
+		if h.Index != "" {
+			index := path.Join(name, h.Index)
+			if indexInfo, err := fs.Stat(h.fsys, index); err == nil && !indexInfo.IsDir() {
+				h.serveFile(w, r, index, indexInfo)
+				return
+			}
+		}
+		if h.Listing {
+			http.FileServerFS(h.fsys).ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if err == nil {
+		h.serveFile(w, r, name, info)
+		return
+	}
+
+	if !isNotFoundError(err) {
+		h.logger.Error("stat static file", name, "failed with", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if h.Fallback != "" && path.Ext(name) == "" {
+		if info, err := fs.Stat(h.fsys, h.Fallback); err == nil && !info.IsDir() {
+			h.serveFile(w, r, h.Fallback, info)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// serveFile serves file or its precompressed sibling with cache headers
+func (h *staticHandler) serveFile(w http.ResponseWriter, r *http.Request, name string, info fs.FileInfo) {
+	header := w.Header()
+	servedName, servedInfo := name, info
+	if h.Precompressed {
+		header.Add("Vary", "Accept-Encoding")
+		if encoding, sibling, siblingInfo := h.precompressed(r, name); sibling != "" {
+			servedName, servedInfo = sibling, siblingInfo
+			header.Set("Content-Encoding", encoding)
+		}
+	}
+
+	f, err := h.fsys.Open(servedName)
+	if err != nil {
+		h.logger.Error("open static file", servedName, "failed with", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			h.logger.Error("read static file", servedName, "failed with", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	etag, err := h.etag(servedName, servedInfo, content)
+	if err != nil {
+		h.logger.Error("hash static file", servedName, "failed with", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	header.Set("ETag", etag)
+	if value := h.cacheControl("/" + name); value != "" {
+		header.Set("Cache-Control", value)
+	}
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		// type of original file, content of compressed sibling would be sniffed as binary
+		header.Set("Content-Type", ctype)
+	}
+	http.ServeContent(w, r, name, servedInfo.ModTime(), content)
+}
+
+// precompressed returns encoding and sibling of file accepted by client, sibling is empty if there is none
+func (h *staticHandler) precompressed(r *http.Request, name string) (string, string, fs.FileInfo) {
+	accepted := r.Header.Get("Accept-Encoding")
+	for _, candidate := range []struct{ encoding, ext string }{{"br", ".br"}, {"gzip", ".gz"}} {
+		if !acceptsEncoding(accepted, candidate.encoding) {
+			continue
+		}
+		if info, err := fs.Stat(h.fsys, name+candidate.ext); err == nil && !info.IsDir() {
+			return candidate.encoding, name + candidate.ext, info
+		}
+	}
+	return "", "", nil
+}
+
+// etag returns strong etag of content, it is cached until file changes
+func (h *staticHandler) etag(name string, info fs.FileInfo, content io.ReadSeeker) (string, error) {
+	key := name + "|" + strconv.FormatInt(info.ModTime().UnixNano(), 10) + "|" + strconv.FormatInt(info.Size(), 10)
+	if v, ok := h.etags.Load(key); ok {
+		return v.(string), nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+	h.etags.Store(key, etag)
+	return etag, nil
+}
+
+// cacheControl returns Cache-Control of the first rule matching file path or its base name
+func (h *staticHandler) cacheControl(upath string) string {
+	for _, rule := range h.CacheControl {
+		if ok, _ := path.Match(rule.Pattern, upath); ok {
+			return rule.Value
+		}
+		if ok, _ := path.Match(rule.Pattern, path.Base(upath)); ok {
+			return rule.Value
+		}
+	}
+	return ""
+}
+
+// hasDotSegment checks whether any segment of path starts with dot
+func hasDotSegment(upath string) bool {
+	for _, segment := range strings.Split(upath, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding checks whether Accept-Encoding accepts encoding with non-zero quality
+func acceptsEncoding(accepted, encoding string) bool {
+	for _, part := range strings.Split(accepted, ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), encoding) {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// localRedirect redirects to target relative to request path, like http.FileServer does
+func localRedirect(w http.ResponseWriter, r *http.Request, target string) {
+	if q := r.URL.RawQuery; q != "" {
+		target += "?" + q
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+// isNotFoundError checks whether error of file system means path is not found, such as path
+// under a regular file, like mapOpenError of http.Dir does
+func isNotFoundError(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) || errors.Is(err, syscall.ENOTDIR)
+}
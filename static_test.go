@@ -0,0 +1,104 @@
+package webservice
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStaticHandler(t *testing.T) {
+	files := fstest.MapFS{
+		"index.html":      {Data: []byte("<html>app</html>")},
+		"app.js":          {Data: []byte("console.log(1)")},
+		"app.js.gz":       {Data: []byte("gzip")},
+		"app.js.br":       {Data: []byte("brotli")},
+		".env":            {Data: []byte("SECRET=1")},
+		"assets/logo.svg": {Data: []byte("<svg/>")},
+	}
+	conf := BuildStaticConfig("")
+	conf.FS = files
+	conf.Fallback = "index.html"
+	conf.Logger = &logger{level: logLevelError}
+	conf.CacheControl = append(conf.CacheControl,
+		CacheControlRule{Pattern: "/assets/*", Value: "public, max-age=31536000, immutable"},
+		CacheControlRule{Pattern: "*.js", Value: "public, max-age=3600"})
+	handler := http.StripPrefix("/static/", BuildStaticHandler(conf))
+
+	do := func(method, path string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("GET", "/static/", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "<html>app</html>" || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Fatal("unexpected index", w.Code, w.Body.String(), w.Header())
+	}
+
+	w = do("GET", "/static/app.js", map[string]string{"Accept-Encoding": "gzip, br"})
+	if w.Body.String() != "brotli" || w.Header().Get("Content-Encoding") != "br" ||
+		w.Header().Get("Content-Type") != "text/javascript; charset=utf-8" ||
+		w.Header().Get("Vary") != "Accept-Encoding" || w.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Fatal("unexpected brotli response", w.Body.String(), w.Header())
+	}
+	w = do("GET", "/static/app.js", map[string]string{"Accept-Encoding": "gzip, br;q=0"})
+	if w.Body.String() != "gzip" || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("unexpected gzip response", w.Body.String(), w.Header())
+	}
+	w = do("GET", "/static/app.js", nil)
+	etag := w.Header().Get("ETag")
+	if w.Body.String() != "console.log(1)" || w.Header().Get("Content-Encoding") != "" || len(etag) < 3 || etag[0] != '"' {
+		t.Fatal("unexpected identity response", w.Body.String(), w.Header())
+	}
+	if w = do("GET", "/static/app.js", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified {
+		t.Fatal("expected not modified, got", w.Code)
+	}
+
+	if w = do("GET", "/static/assets/logo.svg", nil); w.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Fatal("unexpected cache control", w.Header())
+	}
+	if w = do("GET", "/static/assets", nil); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "assets/" {
+		t.Fatal("expected redirect to directory, got", w.Code, w.Header())
+	}
+	if w = do("GET", "/static/assets/", nil); w.Code != http.StatusNotFound {
+		t.Fatal("directory is listed", w.Code)
+	}
+	if w = do("GET", "/static/.env", nil); w.Code != http.StatusNotFound {
+		t.Fatal("dotfile is served", w.Code)
+	}
+	if w = do("GET", "/static/settings/profile", nil); w.Code != http.StatusOK || w.Body.String() != "<html>app</html>" {
+		t.Fatal("unexpected fallback", w.Code, w.Body.String())
+	}
+	if w = do("GET", "/static/missing.css", nil); w.Code != http.StatusNotFound {
+		t.Fatal("missing asset falls back", w.Code)
+	}
+	if w = do("POST", "/static/app.js", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Fatal("unexpected status of post", w.Code)
+	}
+}
+
+func TestStaticHandlerPathUnderFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log(1)"), 0600)
+
+	conf := BuildStaticConfig(dir)
+	conf.Logger = &logger{level: logLevelError}
+	handler := BuildStaticHandler(conf)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/app.js/x", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatal("unexpected status of path under file", w.Code)
+	}
+}
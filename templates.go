@@ -1,6 +1,7 @@
 package webservice
 
 import (
+	"bytes"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -47,8 +48,53 @@ func (mgr *templatesManager) RenderTemplate(w http.ResponseWriter, name string,
 		return fmt.Errorf("the template %v is not existed", name)
 	}
 
+	// bind template funcs to state of request rendered for,
+	// parsed template is never executed since html template can not be cloned after execution
+	cloned, err := tpl.Clone()
+	if err != nil {
+		return err
+	}
+	tpl = cloned.Funcs(templateFuncs(requestStateOfWriter(w)))
+
+	// template is rendered before response is written, so that session accessed by template,
+	// such as its flashes, is committed after rendering
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return err
+	}
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	return tpl.ExecuteTemplate(w, name, data)
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// templateFuncs returns funcs bound to request state, templates are parsed with funcs of nil state
+func templateFuncs(state *requestState) template.FuncMap {
+	return template.FuncMap{
+		"cspNonce": func() string {
+			return state.nonce()
+		},
+		"csrfToken": func() string {
+			return state.csrfToken()
+		},
+		"session": func() *Session {
+			return state.sessionOf()
+		},
+		"flashes": func() []string {
+			return state.sessionOf().Flashes()
+		},
+		// csrfField renders hidden input carrying csrf token
+		"csrfField": func() template.HTML {
+			if state == nil || state.csrfField == "" {
+				return ""
+			}
+			token := state.csrfToken()
+			if token == "" {
+				return ""
+			}
+			return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(state.csrfField) +
+				`" value="` + template.HTMLEscapeString(token) + `">`)
+		},
+	}
 }
 
 func (mgr *templatesManager) Refresh(pagesTemplateDir, pagePattern,
@@ -86,7 +132,7 @@ func (mgr *templatesManager) Refresh(pagesTemplateDir, pagePattern,
 		files := make([]string, 0, len(widgets)+1)
 		files = append(files, page)
 		files = append(files, widgets...)
-		if tpl, err := template.ParseFiles(files...); err == nil {
+		if tpl, err := template.New(filepath.Base(page)).Funcs(templateFuncs(nil)).ParseFiles(files...); err == nil {
 			templates[filepath.Base(page)] = tpl
 			mgr.logger.Debug("parsed html template of", files)
 		} else {
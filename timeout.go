@@ -0,0 +1,211 @@
+package webservice
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// timeoutWriter serializes writes of handler and timer, writes of handler are dropped after timeout.
+// Handler sets headers of its own, they are copied to wrapped writer when handler writes header.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx         context.Context
+	header      http.Header
+	lock        sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+	done        bool
+	// expire writes timeout response, it is called with lock held
+	expire func()
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+// copyHeader replaces header of wrapped writer with header set by handler, it is called with lock held
+func (tw *timeoutWriter) copyHeader() {
+	dst := tw.ResponseWriter.Header()
+	for k := range dst {
+		if _, ok := tw.header[k]; !ok {
+			delete(dst, k)
+		}
+	}
+	for k, v := range tw.header {
+		dst[k] = v
+	}
+}
+
+// checkDeadline expires writer if deadline of context is exceeded before timer fires,
+// it is called with lock held
+func (tw *timeoutWriter) checkDeadline() {
+	if !tw.timedOut && tw.ctx.Err() == context.DeadlineExceeded {
+		tw.expire()
+	}
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	tw.checkDeadline()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.copyHeader()
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) Write(data []byte) (int, error) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	tw.checkDeadline()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		tw.copyHeader()
+	}
+	return tw.ResponseWriter.Write(data)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	tw.checkDeadline()
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok && !tw.timedOut {
+		if !tw.wroteHeader {
+			tw.wroteHeader = true
+			tw.copyHeader()
+		}
+		f.Flush()
+	}
+}
+
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+	tw.checkDeadline()
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	hj, ok := tw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		// hijacked connection belongs to handler, timeout response can not be written any more
+		tw.wroteHeader = true
+	}
+	return conn, brw, err
+}
+
+// Unwrap returns wrapped writer
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// routeTimeout returns handler timeout of route
+func (ws *webService) routeTimeout(route string) time.Duration {
+	if v, ok := ws.RouteTimeouts[route]; ok {
+		return v
+	}
+	return ws.HandlerTimeout
+}
+
+// runHandler runs handler with timeout of route, handler should use the request whose context
+// is canceled at timeout. Handler runs in its own goroutine, so service unavailable response is
+// written and finished at timeout even if handler ignores its context, later writes of handler
+// are dropped. The returned channel is nil if handler returned in time, otherwise it is closed
+// once handler returns, resources used by handler must be kept until then.
+func (ws *webService) runHandler(route string, handler RequestHandlerFunc,
+	w http.ResponseWriter, r *http.Request) (*ServiceResponse, <-chan struct{}) {
+
+	timeout := ws.routeTimeout(route)
+	if timeout <= 0 {
+		return handler(w, r, ws), nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	// context is done already when handler overruns, otherwise it is canceled after handler returns
+	defer cancel()
+	r = r.WithContext(ctx)
+	tw := &timeoutWriter{ResponseWriter: w, ctx: ctx, header: w.Header().Clone()}
+	// csrf token issued by handler sets its cookie through tw like other headers of handler,
+	// writer of token is restored if handler returns in time
+	var csrf *csrfHolder
+	if state := requestStateFromRequest(r); state != nil {
+		csrf = state.csrf
+	}
+	outer := csrf.setWriter(tw)
+	tw.expire = func() {
+		tw.timedOut = true
+		ws.Logger.Warn("service", ws.server.Addr, "handler of", route, "timed out after", timeout)
+		if !tw.wroteHeader {
+			jsonResponseWithStatus(w, r, &ServiceResponse{
+				Status:  http.StatusServiceUnavailable,
+				Message: "request timeout",
+				Data:    map[int]int{},
+			}, http.StatusServiceUnavailable, ws.server.Addr, ws.Logger)
+		}
+	}
+
+	var resp *ServiceResponse
+	running := make(chan struct{})
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer close(running)
+		defer func() {
+			if p := recover(); p != nil {
+				tw.lock.Lock()
+				defer tw.lock.Unlock()
+				if tw.done {
+					// nobody waits for handler any more
+					ws.Logger.Error("service", ws.server.Addr, "handler of", route, "panicked after timeout with", p)
+					return
+				}
+				panicked <- p
+			}
+		}()
+		resp = handler(tw, r, ws)
+	}()
+
+	select {
+	case <-running:
+		select {
+		case p := <-panicked:
+			panic(p)
+		default:
+		}
+		tw.lock.Lock()
+		defer tw.lock.Unlock()
+		tw.checkDeadline()
+		tw.done = true
+		if tw.timedOut {
+			return nil, running
+		}
+		if !tw.wroteHeader {
+			// response of handler is written by caller
+			tw.copyHeader()
+		}
+		csrf.setWriter(outer)
+		return resp, nil
+	case <-ctx.Done():
+		tw.lock.Lock()
+		defer tw.lock.Unlock()
+		if ctx.Err() == context.DeadlineExceeded {
+			tw.checkDeadline()
+		} else {
+			// request is canceled by client, there is nobody to respond
+			tw.timedOut = true
+		}
+		tw.done = true
+		return nil, running
+	}
+}
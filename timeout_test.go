@@ -0,0 +1,124 @@
+package webservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDispatchRouteTimeout(t *testing.T) {
+	ctxErr := make(chan error, 1)
+	slow := func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+		<-r.Context().Done()
+		ctxErr <- r.Context().Err()
+		w.Write([]byte("late"))
+		return nil
+	}
+	fast := func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+		return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+	}
+	ws := buildTestService(map[string]RequestHandlerFunc{"/slow": slow, "/fast": fast})
+	ws.HandlerTimeout = time.Minute
+	ws.RouteTimeouts = map[string]time.Duration{"/slow": 20 * time.Millisecond}
+
+	do := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		ws.dispatch(w, r)
+		return w
+	}
+
+	w := do("/slow")
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() == "late" {
+		t.Fatalf("expected timeout response, got %v %q", w.Code, w.Body.String())
+	}
+	if err := <-ctxErr; err != context.DeadlineExceeded {
+		t.Fatalf("expected request context to be canceled by deadline, got %v", err)
+	}
+	if w := do("/fast"); w.Code != http.StatusOK {
+		t.Fatalf("unexpected status of fast handler %v", w.Code)
+	}
+}
+
+func TestTimeoutOfHandlerIgnoringContext(t *testing.T) {
+	unblock := make(chan struct{})
+	returned := make(chan struct{})
+	ws := buildTestService(map[string]RequestHandlerFunc{
+		"/stuck": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			defer close(returned)
+			<-unblock
+			return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+		},
+	})
+	ws.HandlerTimeout = 20 * time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(ws.dispatch))
+	defer ts.Close()
+	defer close(unblock)
+
+	rsp, err := (&http.Client{Timeout: 5 * time.Second}).Get(ts.URL + "/stuck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected timeout response, got %v", rsp.StatusCode)
+	}
+	select {
+	case <-returned:
+		t.Fatal("response waits for handler")
+	default:
+	}
+}
+
+func TestTimeoutOfHandlerSettingHeaders(t *testing.T) {
+	unblock := make(chan struct{})
+	returned := make(chan string, 1)
+	ws := buildTestService(map[string]RequestHandlerFunc{
+		"/stuck": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			// keep setting headers while timeout response is written
+			for {
+				w.Header().Set("X-Late", "1")
+				select {
+				case <-unblock:
+					returned <- CSRFTokenFromRequest(r)
+					return nil
+				case <-time.After(time.Millisecond):
+				}
+			}
+		},
+		"/fast": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			w.Header().Set("X-Fast", "1")
+			CSRFTokenFromRequest(r)
+			return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+		},
+	})
+	ws.HandlerTimeout = 20 * time.Millisecond
+	ws.CSRF = BuildCSRFConfig([]byte("secret"), "/stuck", "/fast")
+	ws.initRequestLayers()
+	ts := httptest.NewServer(ws.withRequestState(http.HandlerFunc(ws.dispatch)))
+	defer ts.Close()
+
+	rsp, err := http.Get(ts.URL + "/stuck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	// headers and token cookie set by handler after timeout are dropped without racing timeout response
+	close(unblock)
+	<-returned
+	if rsp.StatusCode != http.StatusServiceUnavailable || rsp.Header.Get("X-Late") != "" {
+		t.Fatalf("unexpected timeout response %v %v", rsp.StatusCode, rsp.Header)
+	}
+
+	rsp, err = http.Get(ts.URL + "/fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.Header.Get("X-Fast") != "1" || len(rsp.Cookies()) == 0 {
+		t.Fatalf("headers of handler are not written %v", rsp.Header)
+	}
+}
@@ -0,0 +1,216 @@
+package webservice
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+)
+
+// TLSCertificate stores paths of a certificate and its key
+type TLSCertificate struct {
+	CertFile string
+	KeyFile  string
+}
+
+// tlsEnabled checks whether web service has any certificate
+func (conf *Config) tlsEnabled() bool {
+	return conf.hasCertificateFiles() || conf.ACME != nil
+}
+
+// hasCertificateFiles checks whether web service has any static certificate
+func (conf *Config) hasCertificateFiles() bool {
+	return (strings.TrimSpace(conf.TLSCert) != "" && strings.TrimSpace(conf.TLSKey) != "") ||
+		len(conf.TLSCertificates) > 0
+}
+
+// certificateManager loads certificates and selects one of them by sni,
+// certificates are reloaded while their files are changed
+type certificateManager struct {
+	files  []TLSCertificate
+	dirs   map[string]bool
+	logger Logger
+
+	lock   sync.RWMutex
+	certs  []*tls.Certificate
+	byName map[string]*tls.Certificate
+}
+
+// buildCertificateManager builds certificate manager of TLSCert/TLSKey and TLSCertificates,
+// the first one is default certificate for clients without sni or with unknown names
+func buildCertificateManager(conf *Config, log Logger) (*certificateManager, error) {
+	mgr := &certificateManager{dirs: make(map[string]bool), logger: log}
+	if strings.TrimSpace(conf.TLSCert) != "" && strings.TrimSpace(conf.TLSKey) != "" {
+		mgr.files = append(mgr.files, TLSCertificate{
+			CertFile: strings.TrimSpace(conf.TLSCert),
+			KeyFile:  strings.TrimSpace(conf.TLSKey),
+		})
+	}
+	mgr.files = append(mgr.files, conf.TLSCertificates...)
+	if len(mgr.files) == 0 {
+		return nil, ErrorInvalidArgument
+	}
+
+	for _, f := range mgr.files {
+		for _, path := range []string{f.CertFile, f.KeyFile} {
+			if dir, err := filepath.Abs(filepath.Dir(path)); err == nil {
+				mgr.dirs[dir] = true
+			}
+		}
+	}
+
+	if err := mgr.reload(); err != nil {
+		return nil, err
+	}
+	return mgr, nil
+}
+
+// reload loads all certificates, current certificates are kept if any of them fails
+func (mgr *certificateManager) reload() error {
+	certs := make([]*tls.Certificate, 0, len(mgr.files))
+	byName := make(map[string]*tls.Certificate)
+	for _, f := range mgr.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			mgr.logger.Error("load certificate", f.CertFile, "failed with", err)
+			return err
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			mgr.logger.Error("parse certificate", f.CertFile, "failed with", err)
+			return err
+		}
+		cert.Leaf = leaf
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// earlier certificates win for names they share
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+		certs = append(certs, &cert)
+		mgr.logger.Trace("loaded certificate", f.CertFile, "for", names)
+	}
+
+	mgr.lock.Lock()
+	mgr.certs, mgr.byName = certs, byName
+	mgr.lock.Unlock()
+	return nil
+}
+
+// watches checks whether path is in directories of certificate files
+func (mgr *certificateManager) watches(path string) bool {
+	if mgr == nil {
+		return false
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	return err == nil && mgr.dirs[dir]
+}
+
+// GetCertificate selects certificate by exact name, then by wildcard name, then the default one
+func (mgr *certificateManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	mgr.lock.RLock()
+	defer mgr.lock.RUnlock()
+
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if cert, ok := mgr.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := mgr.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	if len(mgr.certs) == 0 {
+		return nil, ErrorNotFound
+	}
+	return mgr.certs[0], nil
+}
+
+// initTLS loads certificates and client cas and sets tls config of server, directories of
+// certificates and revocation lists are watched by initTemplatesManager so that they are reloaded on change
+func (ws *webService) initTLS() {
+	var err error
+	if ws.ClientAuth != nil {
+		ws.clientAuth, err = buildClientAuthenticator(ws.ClientAuth, ws.Logger)
+		if err != nil {
+			ws.Logger.Error("build client authenticator failed with", err)
+			panic(err)
+		}
+	}
+
+	if !ws.tlsEnabled() {
+		if ws.clientAuth != nil {
+			ws.Logger.Warn("client certificates are configured without tls, routes requiring them are rejected")
+		}
+		return
+	}
+
+	if ws.hasCertificateFiles() {
+		ws.certificates, err = buildCertificateManager(&ws.Config, ws.Logger)
+		if err != nil {
+			ws.Logger.Error("load certificates failed with", err)
+			panic(err)
+		}
+	}
+	if ws.ACME != nil {
+		ws.acme, err = buildACMEManager(ws.ACME, ws.Logger)
+		if err != nil {
+			ws.Logger.Error("build acme manager failed with", err)
+			panic(err)
+		}
+	}
+
+	ws.server.TLSConfig = &tls.Config{
+		GetCertificate: ws.getCertificate,
+		MinVersion:     ws.TLSMinVersion,
+		CipherSuites:   ws.TLSCipherSuites,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if ws.TLSDisableHTTP2 {
+		ws.server.TLSConfig.NextProtos = []string{"http/1.1"}
+		ws.server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	if ws.acme != nil && ws.acme.solvesTLSALPN() {
+		ws.server.TLSConfig.NextProtos = append(ws.server.TLSConfig.NextProtos, acme.ALPNProto)
+	}
+	if ws.clientAuth != nil {
+		ws.clientAuth.configure(ws.server.TLSConfig)
+	}
+}
+
+// getCertificate selects certificate from acme for its hosts and challenges, then from static certificates
+func (ws *webService) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if ws.acme != nil {
+		if cert, handled, err := ws.acme.getCertificate(hello); handled {
+			return cert, err
+		}
+	}
+	if ws.certificates == nil {
+		return nil, ErrorHostNotAllowed
+	}
+	return ws.certificates.GetCertificate(hello)
+}
+
+// tlsWatchedDirs returns directories of certificates and revocation lists
+func (ws *webService) tlsWatchedDirs() map[string]bool {
+	dirs := make(map[string]bool)
+	if ws.certificates != nil {
+		for dir := range ws.certificates.dirs {
+			dirs[dir] = true
+		}
+	}
+	if ws.clientAuth != nil && ws.clientAuth.dir != "" {
+		dirs[ws.clientAuth.dir] = true
+	}
+	return dirs
+}
@@ -0,0 +1,159 @@
+package webservice
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// createTestCertificate creates certificate of template signed by parent, it is self-signed if parent is nil
+func createTestCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeTestPEM writes certificate and its key into dir
+func writeTestPEM(t *testing.T, dir, file string, cert *x509.Certificate, key *ecdsa.PrivateKey) TLSCertificate {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := TLSCertificate{
+		CertFile: filepath.Join(dir, file+".crt"),
+		KeyFile:  filepath.Join(dir, file+".key"),
+	}
+	if err := ioutil.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// writeTestCertificate writes a self-signed server certificate of names and its key into dir
+func writeTestCertificate(t *testing.T, dir, file, commonName string, names ...string) TLSCertificate {
+	cert, key := createTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    names,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil, nil)
+	return writeTestPEM(t, dir, file, cert, key)
+}
+
+func TestCertificateManagerSNIAndReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	def := writeTestCertificate(t, dir, "default", "default.example.com", "default.example.com")
+	wildcard := writeTestCertificate(t, dir, "wildcard", "", "*.apps.example.com")
+	conf := BuildConfig()
+	conf.TLSCert, conf.TLSKey = def.CertFile, def.KeyFile
+	conf.TLSCertificates = []TLSCertificate{wildcard}
+
+	mgr, err := buildCertificateManager(conf, &logger{level: logLevelError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mgr.watches(wildcard.KeyFile) || mgr.watches(filepath.Join(os.TempDir(), "x.crt")) {
+		t.Fatal("unexpected watched directories", mgr.dirs)
+	}
+
+	served := func(name string) string {
+		cert, err := mgr.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cert.Leaf.DNSNames) == 0 {
+			return ""
+		}
+		return cert.Leaf.DNSNames[0]
+	}
+	for name, expected := range map[string]string{
+		"default.example.com":  "default.example.com",
+		"WEB.apps.example.com": "*.apps.example.com",
+		"a.b.apps.example.com": "default.example.com",
+		"":                     "default.example.com",
+	} {
+		if got := served(name); got != expected {
+			t.Fatal(name, "is served by", got, "expected", expected)
+		}
+	}
+
+	// rotated certificate is served after reload
+	writeTestCertificate(t, dir, "wildcard", "", "*.apps.example.com", "api.example.com")
+	if err := mgr.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := served("api.example.com"); got != "*.apps.example.com" {
+		t.Fatal("rotated certificate is not served, got", got)
+	}
+
+	// broken files keep current certificates
+	if err := ioutil.WriteFile(wildcard.KeyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.reload(); err == nil {
+		t.Fatal("expected reload error")
+	}
+	if got := served("api.example.com"); got != "*.apps.example.com" {
+		t.Fatal("certificates are not kept, got", got)
+	}
+}
+
+func TestInitTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ws := buildTestService(nil)
+	ws.TLSCertificates = []TLSCertificate{writeTestCertificate(t, dir, "a", "a.example.com")}
+	ws.TLSDisableHTTP2 = true
+	ws.initTLS()
+
+	conf := ws.server.TLSConfig
+	if conf == nil || conf.MinVersion != tls.VersionTLS12 || len(conf.NextProtos) != 1 || ws.server.TLSNextProto == nil {
+		t.Fatal("unexpected tls config", conf)
+	}
+	cert, err := conf.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	if err != nil || cert.Leaf.Subject.CommonName != "a.example.com" {
+		t.Fatal("unexpected certificate", cert, err)
+	}
+}
@@ -0,0 +1,312 @@
+package webservice
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// sniffLen is count of leading bytes used to detect content type
+const sniffLen = 512
+
+// UploadStorage defines storage backend of uploaded files
+type UploadStorage interface {
+	// Create opens writer of a new stored file
+	Create(name string) (io.WriteCloser, error)
+	// Remove removes a stored file, it is used to clean up rejected uploads
+	Remove(name string) error
+	// Location returns where stored file can be found, such as file path or url
+	Location(name string) string
+}
+
+// UploadConfig stores limits and storage of streaming uploads
+type UploadConfig struct {
+	Storage UploadStorage
+	// MaxFileSize limits bytes of each file, zero means no limit
+	MaxFileSize int64
+	// MaxTotalSize limits bytes of all files and values, zero means no limit
+	MaxTotalSize int64
+	// MaxFiles limits count of files, zero means no limit
+	MaxFiles int
+	// MaxValueSize limits bytes of each non-file field kept in memory
+	MaxValueSize int64
+	// AllowedTypes lists allowed sniffed content types, such as image/png or image/*
+	AllowedTypes []string
+	// AllowedExtensions lists allowed filename extensions, such as .png
+	AllowedExtensions []string
+}
+
+// UploadedFile stores metadata of an uploaded file
+type UploadedFile struct {
+	FieldName string
+	// Filename is sanitized filename sent by client
+	Filename    string
+	StoredName  string
+	Location    string
+	Size        int64
+	ContentType string
+	MD5         string
+	SHA256      string
+}
+
+// UploadResult stores uploaded files and values of a multipart form
+type UploadResult struct {
+	Files  []*UploadedFile
+	Values map[string][]string
+}
+
+// BuildUploadConfig builds a default upload config which stores files in dir
+func BuildUploadConfig(dir string) *UploadConfig {
+	return &UploadConfig{
+		Storage:      BuildDirUploadStorage(dir),
+		MaxFileSize:  32 << 20,
+		MaxTotalSize: 64 << 20,
+		MaxFiles:     16,
+		MaxValueSize: 1 << 20,
+	}
+}
+
+// ReceiveUploads streams file parts of multipart request to storage as they arrive,
+// stored files are removed if any limit is exceeded
+func ReceiveUploads(r *http.Request, conf *UploadConfig, logger Logger) (result *UploadResult, err error) {
+	logger.Debug("entered...")
+	defer func() { logger.Debug("done with error", err) }()
+
+	if conf == nil || conf.Storage == nil {
+		return nil, ErrorInvalidArgument
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		logger.Warn("r.MultipartReader returned error", err)
+		return nil, err
+	}
+
+	result = &UploadResult{Values: make(map[string][]string)}
+	defer func() {
+		if err != nil {
+			for _, f := range result.Files {
+				conf.Storage.Remove(f.StoredName)
+			}
+			result = nil
+		}
+	}()
+
+	var total int64
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Warn("read next part failed with", err)
+			return result, err
+		}
+
+		if p.FileName() == "" {
+			value, err := readLimited(p, remainingLimit(conf.MaxValueSize, conf.MaxTotalSize, total))
+			if err != nil {
+				return result, err
+			}
+			total += int64(len(value))
+			result.Values[p.FormName()] = append(result.Values[p.FormName()], string(value))
+			continue
+		}
+
+		if conf.MaxFiles > 0 && len(result.Files) >= conf.MaxFiles {
+			return result, ErrorTooManyFiles
+		}
+		file, err := storeUploadPart(p, conf, remainingLimit(conf.MaxFileSize, conf.MaxTotalSize, total))
+		if file != nil {
+			total += file.Size
+			result.Files = append(result.Files, file)
+		}
+		if err != nil {
+			logger.Warn("store uploaded file", p.FileName(), "failed with", err)
+			return result, err
+		}
+		logger.Debug("stored uploaded file", file.Filename, "as", file.StoredName, "size", file.Size)
+	}
+
+	return result, nil
+}
+
+// storeUploadPart streams part to storage, returned file is not nil once it is created in storage
+func storeUploadPart(part *multipart.Part, conf *UploadConfig, limit int64) (*UploadedFile, error) {
+	if limit < 0 {
+		return nil, ErrorUploadTooLarge
+	}
+	file := &UploadedFile{FieldName: part.FormName(), Filename: SanitizeFilename(part.FileName())}
+
+	ext := strings.ToLower(filepath.Ext(file.Filename))
+	if len(conf.AllowedExtensions) > 0 && !containsFold(conf.AllowedExtensions, ext) {
+		return nil, ErrorUploadTypeNotAllowed
+	}
+
+	br := bufio.NewReaderSize(part, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	file.ContentType = http.DetectContentType(head)
+	if len(conf.AllowedTypes) > 0 && !matchMediaType(conf.AllowedTypes, file.ContentType) {
+		return nil, ErrorUploadTypeNotAllowed
+	}
+
+	file.StoredName, err = randomName(ext)
+	if err != nil {
+		return nil, err
+	}
+	w, err := conf.Storage.Create(file.StoredName)
+	if err != nil {
+		return nil, err
+	}
+	file.Location = conf.Storage.Location(file.StoredName)
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	dst := io.MultiWriter(w, md5Hash, sha256Hash)
+	var src io.Reader = br
+	if limit > 0 {
+		src = io.LimitReader(br, limit+1)
+	}
+	file.Size, err = io.Copy(dst, src)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && limit > 0 && file.Size > limit {
+		err = ErrorUploadTooLarge
+	}
+	file.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	file.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	return file, err
+}
+
+// SanitizeFilename strips directories and unsafe characters from client filename
+func SanitizeFilename(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '.', r == '-', r == '_':
+			return r
+		case unicode.IsControl(r):
+			return -1
+		}
+		return '_'
+	}, name)
+	name = strings.TrimLeft(name, ".")
+
+	if len(name) > 255 {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = name[:255-len(ext)] + ext
+	}
+	if name == "" {
+		name = "file"
+	}
+	return name
+}
+
+// remainingLimit returns the stricter one of limit and bytes left by total limit,
+// zero means no limit and negative value means nothing is left
+func remainingLimit(limit, totalLimit, used int64) int64 {
+	if totalLimit <= 0 {
+		return limit
+	}
+	left := totalLimit - used
+	if left <= 0 {
+		return -1
+	}
+	if limit <= 0 || left < limit {
+		return left
+	}
+	return limit
+}
+
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	if limit < 0 {
+		return nil, ErrorUploadTooLarge
+	}
+	if limit == 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err == nil && int64(len(data)) > limit {
+		err = ErrorUploadTooLarge
+	}
+	return data, err
+}
+
+func matchMediaType(allowed []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a == mediaType || a == "*/*" ||
+			(strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, a[:len(a)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// randomName returns random hex name with ext
+func randomName(ext string) (string, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data) + ext, nil
+}
+
+// dirUploadStorage stores uploaded files in a directory
+type dirUploadStorage struct {
+	dir string
+}
+
+// BuildDirUploadStorage builds upload storage which stores files in dir
+func BuildDirUploadStorage(dir string) UploadStorage {
+	return &dirUploadStorage{dir: dir}
+}
+
+func (s *dirUploadStorage) Create(name string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(s.Location(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+}
+
+func (s *dirUploadStorage) Remove(name string) error {
+	return os.Remove(s.Location(name))
+}
+
+func (s *dirUploadStorage) Location(name string) string {
+	return filepath.Join(s.dir, filepath.Base(name))
+}
@@ -0,0 +1,75 @@
+package webservice
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func buildMultipartRequest(t *testing.T, filename string, content []byte) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("title", "report")
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(content)
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/upload", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestReceiveUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := BuildUploadConfig(dir)
+	conf.MaxFileSize = 1024
+	conf.AllowedTypes = []string{"text/*"}
+	log := &logger{level: logLevelError}
+
+	content := []byte("hello uploads")
+	r := buildMultipartRequest(t, "../../etc/passwd", content)
+	result, err := ReceiveUploads(r, conf, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Files) != 1 || result.Values["title"][0] != "report" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	file := result.Files[0]
+	sum := sha256.Sum256(content)
+	if file.Filename != "passwd" || file.Size != int64(len(content)) || file.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected file %+v", file)
+	}
+	if stored, err := ioutil.ReadFile(file.Location); err != nil || !bytes.Equal(stored, content) {
+		t.Fatalf("unexpected stored file %q with error %v", stored, err)
+	}
+
+	r = buildMultipartRequest(t, "big.txt", bytes.Repeat([]byte("a"), 2048))
+	if _, err = ReceiveUploads(r, conf, log); err != ErrorUploadTooLarge {
+		t.Fatalf("expected too large error, got %v", err)
+	}
+
+	r = buildMultipartRequest(t, "image.txt", []byte("\x89PNG\r\n\x1a\n0000"))
+	if _, err = ReceiveUploads(r, conf, log); err != ErrorUploadTypeNotAllowed {
+		t.Fatalf("expected type not allowed error, got %v", err)
+	}
+
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("rejected uploads are not removed, %v files left", len(entries))
+	}
+}
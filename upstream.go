@@ -0,0 +1,338 @@
+package webservice
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// virtualNodesPerWeight is count of hash ring nodes for each weight unit of target
+const virtualNodesPerWeight = 100
+
+type upstream struct {
+	url           *url.URL
+	weight        int
+	currentWeight int
+	active        int
+	fails         int
+	healthy       bool
+	ejectedUntil  time.Time
+	breaker       *circuitBreaker
+}
+
+type ringNode struct {
+	hash  uint32
+	index int
+}
+
+type upstreamPool struct {
+	UpstreamPoolConfig
+	upstreams []*upstream
+	ring      []ringNode
+	next      int
+	lock      sync.Mutex
+	stop      chan struct{}
+	logger    Logger
+}
+
+func buildUpstreamPool(conf *UpstreamPoolConfig, proxyConf *ProxyConfig, log Logger) (*upstreamPool, error) {
+	if conf == nil || strings.TrimSpace(conf.Name) == "" || len(conf.Targets) == 0 {
+		return nil, ErrorInvalidArgument
+	}
+
+	switch conf.Balance {
+	case "":
+		conf.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceWeighted, BalanceLeastConn, BalanceHash:
+	default:
+		return nil, fmt.Errorf("unknown balance %v of upstream pool %v", conf.Balance, conf.Name)
+	}
+
+	pool := &upstreamPool{UpstreamPoolConfig: *conf, logger: log, stop: make(chan struct{})}
+	for _, t := range conf.Targets {
+		u, err := url.Parse(t.URL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid target %v of upstream pool %v", t.URL, conf.Name)
+		}
+		weight := t.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		pool.upstreams = append(pool.upstreams, &upstream{
+			url:     u,
+			weight:  weight,
+			healthy: true,
+			breaker: buildCircuitBreaker(proxyConf),
+		})
+	}
+
+	for i, u := range pool.upstreams {
+		for n := 0; n < u.weight*virtualNodesPerWeight; n++ {
+			key := fmt.Sprintf("%v#%v", u.url.String(), n)
+			pool.ring = append(pool.ring, ringNode{hash: crc32.ChecksumIEEE([]byte(key)), index: i})
+		}
+	}
+	sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i].hash < pool.ring[j].hash })
+
+	return pool, nil
+}
+
+func (u *upstream) available(now time.Time) bool {
+	return u.healthy && !now.Before(u.ejectedUntil) && u.breaker.ready(now)
+}
+
+// pick selects an available upstream and marks a request in flight on it
+func (pool *upstreamPool) pick(r *http.Request) (*upstream, error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	var selected *upstream
+	switch pool.Balance {
+	case BalanceWeighted:
+		selected = pool.pickWeighted()
+	case BalanceLeastConn:
+		selected = pool.pickLeastConn()
+	case BalanceHash:
+		selected = pool.pickHash(pool.hashKey(r))
+	default:
+		selected = pool.pickRoundRobin()
+	}
+
+	if selected == nil {
+		pool.logger.Warn("upstream pool", pool.Name, "has no available target")
+		return nil, ErrorNoUpstream
+	}
+	if !selected.breaker.allow(time.Now()) {
+		return nil, ErrorCircuitOpen
+	}
+	selected.active++
+	return selected, nil
+}
+
+func (pool *upstreamPool) pickRoundRobin() *upstream {
+	now := time.Now()
+	for i := 0; i < len(pool.upstreams); i++ {
+		u := pool.upstreams[(pool.next+i)%len(pool.upstreams)]
+		if u.available(now) {
+			pool.next = (pool.next + i + 1) % len(pool.upstreams)
+			return u
+		}
+	}
+	return nil
+}
+
+// pickWeighted implements smooth weighted round-robin
+func (pool *upstreamPool) pickWeighted() *upstream {
+	now := time.Now()
+	total := 0
+	var best *upstream
+	for _, u := range pool.upstreams {
+		if !u.available(now) {
+			continue
+		}
+		u.currentWeight += u.weight
+		total += u.weight
+		if best == nil || u.currentWeight > best.currentWeight {
+			best = u
+		}
+	}
+	if best != nil {
+		best.currentWeight -= total
+	}
+	return best
+}
+
+func (pool *upstreamPool) pickLeastConn() *upstream {
+	now := time.Now()
+	var best *upstream
+	for i := 0; i < len(pool.upstreams); i++ {
+		u := pool.upstreams[(pool.next+i)%len(pool.upstreams)]
+		if !u.available(now) {
+			continue
+		}
+		// compare active/weight without division
+		if best == nil || u.active*best.weight < best.active*u.weight {
+			best = u
+		}
+	}
+	pool.next = (pool.next + 1) % len(pool.upstreams)
+	return best
+}
+
+func (pool *upstreamPool) pickHash(key string) *upstream {
+	if len(pool.ring) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(pool.ring), func(i int) bool { return pool.ring[i].hash >= h })
+	for i := 0; i < len(pool.ring); i++ {
+		u := pool.upstreams[pool.ring[(start+i)%len(pool.ring)].index]
+		if u.available(now) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (pool *upstreamPool) hashKey(r *http.Request) string {
+	if pool.HashHeader != "" {
+		if v := r.Header.Get(pool.HashHeader); v != "" {
+			return v
+		}
+	}
+	if pool.HashCookie != "" {
+		if c, err := r.Cookie(pool.HashCookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// finish finishes an attempt on upstream, aborted attempts never reached upstream and leave its state
+func (pool *upstreamPool) finish(u *upstream, result attemptResult) {
+	if result != attemptAborted {
+		pool.release(u, result == attemptFailed)
+		return
+	}
+	pool.lock.Lock()
+	u.active--
+	pool.lock.Unlock()
+	u.breaker.finish(attemptAborted)
+}
+
+// release finishes a request on upstream, failed requests may eject upstream for a while
+func (pool *upstreamPool) release(u *upstream, failed bool) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	u.active--
+	u.breaker.report(failed)
+	if !failed {
+		u.fails = 0
+		return
+	}
+
+	u.fails++
+	if pool.MaxFails > 0 && u.fails >= pool.MaxFails {
+		u.fails = 0
+		u.ejectedUntil = time.Now().Add(pool.FailTimeout)
+		pool.logger.Warn("upstream", u.url, "of pool", pool.Name, "is ejected until", u.ejectedUntil)
+	}
+}
+
+// startHealthCheck checks targets by requesting HealthCheckPath periodically
+func (pool *upstreamPool) startHealthCheck(tr http.RoundTripper) {
+	if strings.TrimSpace(pool.HealthCheckPath) == "" {
+		return
+	}
+	interval := pool.HealthCheckInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			pool.checkHealth(tr)
+			select {
+			case <-pool.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (pool *upstreamPool) checkHealth(tr http.RoundTripper) {
+	for _, u := range pool.upstreams {
+		healthy := pool.probe(tr, u)
+		pool.lock.Lock()
+		if u.healthy != healthy {
+			pool.logger.Warn("upstream", u.url, "of pool", pool.Name, "health changed to", healthy)
+		}
+		u.healthy = healthy
+		pool.lock.Unlock()
+	}
+}
+
+func (pool *upstreamPool) probe(tr http.RoundTripper, u *upstream) bool {
+	timeout := pool.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	target := *u.url
+	target.Path = singleJoiningSlash(u.url.Path, pool.HealthCheckPath)
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		pool.logger.Warn("build health check request for", target.String(), "failed with", err)
+		return false
+	}
+	resp, err := tr.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		pool.logger.Trace("health check", target.String(), "failed with", err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+func (pool *upstreamPool) close() {
+	close(pool.stop)
+}
+
+// upstreamURL builds url requested from upstream base for request path
+func upstreamURL(base *url.URL, r *http.Request, path string) *url.URL {
+	u := *base
+	u.Path = singleJoiningSlash(base.Path, path)
+	u.RawPath = ""
+	switch {
+	case base.RawQuery == "":
+		u.RawQuery = r.URL.RawQuery
+	case r.URL.RawQuery != "":
+		u.RawQuery = base.RawQuery + "&" + r.URL.RawQuery
+	}
+	return &u
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash && b != "":
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// isUpstreamFailure checks whether upstream response should be counted as failure
+func isUpstreamFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package webservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamPoolWeighted(t *testing.T) {
+	conf := BuildUpstreamPoolConfig("weighted")
+	conf.Balance = BalanceWeighted
+	conf.Targets = []UpstreamTarget{{URL: "http://a", Weight: 3}, {URL: "http://b", Weight: 1}}
+	pool, err := buildUpstreamPool(conf, BuildProxyConfig(), &logger{level: logLevelError})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	r := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < 8; i++ {
+		u, err := pool.pick(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[u.url.Host]++
+		pool.release(u, false)
+	}
+	if counts["a"] != 6 || counts["b"] != 2 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
+
+func TestUpstreamPoolHashAndEjection(t *testing.T) {
+	conf := BuildUpstreamPoolConfig("hash", "http://a", "http://b", "http://c")
+	conf.Balance = BalanceHash
+	conf.HashHeader = "X-User"
+	conf.MaxFails = 2
+	pool, err := buildUpstreamPool(conf, BuildProxyConfig(), &logger{level: logLevelError})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-User", "alice")
+	first, _ := pool.pick(r)
+	pool.release(first, false)
+	for i := 0; i < 5; i++ {
+		u, _ := pool.pick(r)
+		pool.release(u, false)
+		if u != first {
+			t.Fatalf("hash balancing is not sticky")
+		}
+	}
+
+	for i := 0; i < conf.MaxFails; i++ {
+		u, _ := pool.pick(r)
+		pool.release(u, true)
+	}
+	u, err := pool.pick(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.release(u, false)
+	if u == first {
+		t.Fatalf("failed upstream is not ejected")
+	}
+}
+
+func TestProxyRouteHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + "?" + r.URL.RawQuery))
+	}))
+	defer upstream.Close()
+
+	p := BuildHTTPProxy(nil)
+	defer p.Close()
+	if err := p.AddUpstreamPool(BuildUpstreamPoolConfig("api", upstream.URL+"/v1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := &webService{server: &http.Server{}}
+	ws.Logger = &logger{level: logLevelError}
+	ws.Handlers = map[string]RequestHandlerFunc{
+		"/api/": p.RouteHandler(&ProxyRoute{Pool: "api", StripPrefix: "/api"}),
+	}
+
+	r := httptest.NewRequest("GET", "/api/users?id=1", nil)
+	w := httptest.NewRecorder()
+	ws.dispatch(w, r)
+	if w.Body.String() != "/v1/users?id=1" {
+		t.Fatalf("unexpected upstream request %q", w.Body.String())
+	}
+}
+
+func TestProxyRouteCache(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("cached"))
+	}))
+	defer upstream.Close()
+
+	p := BuildHTTPProxy(nil)
+	defer p.Close()
+	if err := p.AddUpstreamPool(BuildUpstreamPoolConfig("api", upstream.URL)); err != nil {
+		t.Fatal(err)
+	}
+
+	ws := buildTestService(map[string]RequestHandlerFunc{
+		"/api/": p.RouteHandler(&ProxyRoute{Pool: "api", Cache: BuildHTTPCache(nil)}),
+	})
+	for i, expected := range []string{"MISS", "HIT", "HIT"} {
+		r := httptest.NewRequest("GET", "/api/users", nil)
+		r.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		ws.dispatch(w, r)
+		if w.Header().Get("X-Cache") != expected || w.Body.String() != "cached" {
+			t.Fatalf("request %v: expected %v, got %v %q", i, expected, w.Header().Get("X-Cache"), w.Body.String())
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected upstream to be called once, got %v", calls)
+	}
+}
+
+func TestAuthMapOfPrefixRoute(t *testing.T) {
+	ws := buildTestService(map[string]RequestHandlerFunc{
+		"/admin/": func(w http.ResponseWriter, r *http.Request, _ WebService) *ServiceResponse {
+			return &ServiceResponse{Status: ErrorCodeSuccess, Data: map[int]int{}}
+		},
+	})
+	ws.AuthMap = map[string]map[string]int{"/admin/": {"10.0.0.1": 1}}
+
+	for _, path := range []string{"/admin/", "/admin/x", "/ADMIN/x/y"} {
+		for ip, status := range map[string]int{"1.2.3.4": http.StatusForbidden, "10.0.0.1": http.StatusOK} {
+			r := httptest.NewRequest("GET", path, nil)
+			r.RemoteAddr = ip + ":1234"
+			w := httptest.NewRecorder()
+			ws.dispatch(w, r)
+			if w.Code != status {
+				t.Fatal("unexpected status of", ip, path, w.Code)
+			}
+		}
+	}
+}